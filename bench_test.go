@@ -0,0 +1,331 @@
+package filestream_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func BenchmarkWriteManySmallFiles(b *testing.B) {
+	b.ReportAllocs()
+	data := []byte("small file body")
+	for i := 0; i < b.N; i++ {
+		w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			fw, err := w.File("file.txt", filestream.FileOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for k := 0; k < 10; k++ {
+				_, err = fw.Write(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			err = fw.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFraming(b *testing.B) {
+	for _, varint := range []bool{false, true} {
+		name := "decimal"
+		if varint {
+			name = "varint"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			chunk := make([]byte, 1)
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				w, err := filestream.NewWriter(&buf, filestream.StreamOptions{VarintFraming: varint})
+				if err != nil {
+					b.Fatal(err)
+				}
+				fw, err := w.File("bytes", filestream.FileOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < 1000; j++ {
+					chunk[0] = byte(j)
+					_, err = fw.Write(chunk)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err = fw.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				r, err := filestream.NewReader(&buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !r.Next() {
+					b.Fatalf("missing file: %v", r.Err())
+				}
+				_, err = io.Copy(ioutil.Discard, r.File())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(buf.Len()))
+		})
+	}
+}
+
+func BenchmarkCompressionConcurrency(b *testing.B) {
+	// moderately compressible data
+	data := make([]byte, 16<<20)
+	rng := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(16))
+	}
+
+	procs := runtime.GOMAXPROCS(0)
+	if procs < 2 {
+		procs = 2
+	}
+	for _, n := range []int{1, procs} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{
+					Compression:            "gzip",
+					CompressionConcurrency: n,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.WriteFile("data.bin", data, filestream.FileOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChunkSize(b *testing.B) {
+	// the body is written in small pieces, which would otherwise each be sent as a chunk
+	piece := bytes.Repeat([]byte{'x'}, 512)
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			var n int64
+			for i := 0; i < b.N; i++ {
+				cw := &countWriter{}
+				w, err := filestream.NewWriter(cw, filestream.StreamOptions{ChunkSize: size, Checksums: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				fw, err := w.File("data.bin", filestream.FileOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < 8192; j++ {
+					_, err = fw.Write(piece)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err = fw.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				n = cw.n
+			}
+			b.SetBytes(int64(8192 * len(piece)))
+			b.ReportMetric(float64(n-int64(8192*len(piece))), "overhead-bytes")
+		})
+	}
+}
+
+// countWriter discards data while counting it.
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(dat []byte) (int, error) {
+	cw.n += int64(len(dat))
+	return len(dat), nil
+}
+
+func BenchmarkFileReaderCopy(b *testing.B) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	fw, err := w.File("data.bin", filestream.FileOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := bytes.Repeat([]byte{'x'}, 32*1024)
+	for i := 0; i < 512; i++ {
+		_, err = fw.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	for _, writeTo := range []bool{false, true} {
+		name := "Read"
+		if writeTo {
+			name = "WriteTo"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(512 * len(chunk)))
+			for i := 0; i < b.N; i++ {
+				r, err := filestream.NewReader(bytes.NewReader(dat))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !r.Next() {
+					b.Fatalf("missing file: %v", r.Err())
+				}
+				var src io.Reader = r.File()
+				if !writeTo {
+					src = struct{ io.Reader }{src} // hide WriteTo
+				}
+				_, err = io.Copy(struct{ io.Writer }{ioutil.Discard}, src)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFileWriterCopy(b *testing.B) {
+	data := bytes.Repeat([]byte{'x'}, 16<<20)
+	for _, readFrom := range []bool{false, true} {
+		name := "Write"
+		if readFrom {
+			name = "ReadFrom"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{Checksums: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				fw, err := w.File("data.bin", filestream.FileOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				var dst io.Writer = fw
+				if !readFrom {
+					dst = struct{ io.Writer }{fw} // hide ReadFrom
+				}
+				_, err = io.Copy(dst, struct{ io.Reader }{bytes.NewReader(data)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = fw.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = w.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNewReaderFromBytes(b *testing.B) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		err = w.WriteFile("file.txt", []byte("small file body"), filestream.FileOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = w.WriteFile("big.bin", make([]byte, 1<<20), filestream.FileOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	readers := []struct {
+		Name string
+		New  func() (*filestream.Reader, error)
+	}{
+		{"NewReader", func() (*filestream.Reader, error) { return filestream.NewReader(bytes.NewReader(dat)) }},
+		{"FromBytes", func() (*filestream.Reader, error) { return filestream.NewReaderFromBytes(dat) }},
+	}
+	for _, rc := range readers {
+		rc := rc
+		b.Run(rc.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(dat)))
+			for i := 0; i < b.N; i++ {
+				r, err := rc.New()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for r.Next() {
+					_, err = io.Copy(ioutil.Discard, r.File())
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := r.Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
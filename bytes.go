@@ -0,0 +1,66 @@
+package filestream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+)
+
+// EncodeToBytes encodes a set of files into an in-memory stream.
+// The files are written in sorted order of their paths, so the output is deterministic.
+func EncodeToBytes(files map[string][]byte, opts StreamOptions) ([]byte, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		err = w.WriteFile(path, files[path], FileOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeToMap decodes the files in an in-memory stream.
+// Directories and special files are ignored, and hard links are resolved to the contents of their targets.
+func DecodeToMap(data []byte) (map[string][]byte, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for r.Next() {
+		fr := r.File()
+		switch {
+		case fr.HardlinkTo() != "":
+			if body, ok := files[fr.HardlinkTo()]; ok {
+				files[fr.Path()] = body
+			}
+		case fr.Opts().Permissions.IsRegular():
+			body, err := ioutil.ReadAll(fr)
+			if err != nil {
+				return nil, err
+			}
+			files[fr.Path()] = body
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
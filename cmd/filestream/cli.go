@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,10 +12,272 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/jaddr2line/filestream"
 )
 
+// listEntry is the JSON representation of a file in list mode.
+type listEntry struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mode  string `json:"mode"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	Link  string `json:"link,omitempty"`
+}
+
+// uploader is an io.WriteCloser which streams data into the body of an HTTP request.
+type uploader struct {
+	*io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+// upload starts an HTTP request which streams its body from the returned uploader.
+func upload(method string, u string) (*uploader, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(method, u, pr)
+	if err != nil {
+		return nil, err
+	}
+	up := &uploader{
+		PipeWriter: pw,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("failed to upload: %s", resp.Status)
+			}
+		}
+		if err != nil {
+			// fail any further writes
+			pr.CloseWithError(err)
+		}
+		up.done <- err
+	}()
+	return up, nil
+}
+
+// Close ends the request body, and waits for the response.
+func (u *uploader) Close() error {
+	if u.closed {
+		return u.err
+	}
+	u.closed = true
+	u.err = u.PipeWriter.Close()
+	if err := <-u.done; err != nil {
+		u.err = err
+	}
+	return u.err
+}
+
+// maxResumes is the number of times in a row that a download is resumed without making progress before giving up.
+const maxResumes = 5
+
+// downloader is an io.ReadCloser which reads the body of an HTTP response.
+// If the connection is interrupted and the server supports range requests, the download is resumed from where it left off.
+// This works below the filestream Reader, which only sees an uninterrupted stream of bytes.
+type downloader struct {
+	url  string
+	body io.ReadCloser
+
+	// off is the number of bytes read so far
+	off int64
+
+	// validator is the ETag or Last-Modified time of the response, used to check that the stream has not changed when resuming
+	validator string
+
+	// resumable is whether the server supports range requests
+	resumable bool
+
+	// retries is the number of attempts left to resume the download
+	retries int
+}
+
+// download starts downloading the given URL.
+func download(u string) (*downloader, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download: %s", resp.Status)
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return &downloader{
+		url:       u,
+		body:      resp.Body,
+		validator: validator,
+		resumable: resp.Header.Get("Accept-Ranges") == "bytes",
+		retries:   maxResumes,
+	}, nil
+}
+
+func (d *downloader) Read(dst []byte) (int, error) {
+	for {
+		n, err := d.body.Read(dst)
+		d.off += int64(n)
+		if n > 0 {
+			d.retries = maxResumes
+		}
+		if err == nil || err == io.EOF || !d.resumable || d.retries == 0 {
+			return n, err
+		}
+
+		// reconnect and continue from the current offset
+		d.retries--
+		rerr := d.resume()
+		if rerr != nil {
+			return n, fmt.Errorf("%w (failed to resume download: %v)", err, rerr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the body with a range request starting from the current offset.
+func (d *downloader) resume() error {
+	d.body.Close()
+
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.off))
+	if d.validator != "" {
+		// the server sends the whole stream if it has changed, which is rejected below
+		req.Header.Set("If-Range", d.validator)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected response to range request: %s", resp.Status)
+	}
+	if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", d.off)) {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected content range %q", cr)
+	}
+	d.body = resp.Body
+	return nil
+}
+
+func (d *downloader) Close() error {
+	return d.body.Close()
+}
+
+// patternList is a flag which collects glob patterns, and may be repeated.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(pattern string) error {
+	*p = append(*p, pattern)
+	return nil
+}
+
+// expandArgs expands glob patterns in the paths to encode.
+// Arguments without glob metacharacters are used as they are, even if they do not exist.
+func expandArgs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// countWriter counts the bytes written to it, and discards them.
+type countWriter int64
+
+func (cw *countWriter) Write(dat []byte) (int, error) {
+	*cw += countWriter(len(dat))
+	return len(dat), nil
+}
+
+// autoCompression picks a compression algorithm for the paths to encode, based on how well a sample of their files compresses.
+// Up to 64 KiB is sampled from each of the first regular files found, with up to 1 MiB sampled in total.
+// If the sample shrinks by at least 10% with gzip, gzip is used, and otherwise the stream is not compressed.
+func autoCompression(paths []string) (string, error) {
+	const fileSample, totalSample = 64 << 10, 1 << 20
+	var sample []byte
+	errDone := errors.New("sampling done")
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			dat, err := ioutil.ReadAll(io.LimitReader(f, fileSample))
+			if err != nil {
+				return err
+			}
+			sample = append(sample, dat...)
+			if len(sample) >= totalSample {
+				return errDone
+			}
+			return nil
+		})
+		if err == errDone {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(sample) == 0 {
+		return "", nil
+	}
+
+	var cw countWriter
+	z := gzip.NewWriter(&cw)
+	_, err := z.Write(sample)
+	if err != nil {
+		return "", err
+	}
+	err = z.Close()
+	if err != nil {
+		return "", err
+	}
+	if float64(cw) > 0.9*float64(len(sample)) {
+		return "", nil
+	}
+	return "gzip", nil
+}
+
 func main() {
 	var decode bool
 	var stream string
@@ -22,23 +287,41 @@ func main() {
 	var perms bool
 	var base string
 	var list bool
+	var jsonList bool
+	var bufSize int
+	var method string
+	var exclude, include patternList
+	var verbose bool
+	var count int
 
 	flag.BoolVar(&decode, "d", false, "decode a stream")
 	flag.StringVar(&stream, "s", "-", "stream source/destination")
-	flag.StringVar(&sopts.Compression, "z", "", "compression algo to use (gzip/lz4)")
+	flag.StringVar(&sopts.Compression, "z", "", "compression algo to use when encoding (gzip/lz4/brotli, or auto to choose from a sample of the files); decoding always uses the compression recorded in the stream")
 	flag.IntVar(&sopts.CompressionLevel, "l", 0, "compression level")
 	flag.BoolVar(&users, "permUser", false, "preserve owning user")
 	flag.BoolVar(&groups, "permGroup", false, "preserve owning group")
 	flag.BoolVar(&perms, "perms", false, "preserve permissions")
 	flag.StringVar(&base, "C", ".", "base directory")
 	flag.BoolVar(&list, "t", false, "list files & lengths instead of writing")
+	flag.StringVar(&method, "method", "PUT", "HTTP method used to upload an encoded stream")
+	flag.IntVar(&bufSize, "bufsize", 0, "size of the output buffer when encoding (0 for no additional buffering)")
+	flag.BoolVar(&jsonList, "json", false, "list files as JSON objects, one per line (implies -t)")
+	flag.BoolVar(&verbose, "v", false, "log each file to stderr as it is processed")
+	flag.Var(&exclude, "exclude", "glob pattern of paths to skip when encoding (may be repeated)")
+	flag.Var(&include, "include", "glob pattern of files to encode, skipping all others (may be repeated)")
 	flag.Parse()
 
+	if jsonList {
+		list = true
+	}
 	if list {
 		decode = true
 	}
 
 	if decode {
+		if sopts.Compression != "" {
+			fmt.Fprintln(os.Stderr, "warning: -z is ignored when decoding, as the compression is read from the stream")
+		}
 		var sr io.ReadCloser
 		if stream == "-" {
 			sr = os.Stdin
@@ -55,14 +338,11 @@ func main() {
 				}
 				sr = f
 			case "http", "https":
-				resp, err := http.Get(u.String())
+				dl, err := download(u.String())
 				if err != nil {
 					panic(err)
 				}
-				if resp.StatusCode != 200 {
-					panic(fmt.Errorf("failed to download: %s", resp.Status))
-				}
-				sr = resp.Body
+				sr = dl
 			default:
 				panic(errors.New("unsupported url scheme"))
 			}
@@ -73,13 +353,41 @@ func main() {
 			panic(err)
 		}
 		if list {
+			enc := json.NewEncoder(os.Stdout)
 			for d.Next() {
 				f := d.File()
 				n, err := io.Copy(ioutil.Discard, f)
 				if err != nil {
 					panic(err)
 				}
+				if jsonList {
+					fo := f.Opts()
+					e := listEntry{
+						Path:  f.Path(),
+						Type:  "special",
+						Size:  n,
+						Mode:  fmt.Sprintf("%04o", fo.Permissions.Perm()),
+						User:  fo.User,
+						Group: fo.Group,
+						Link:  f.HardlinkTo(),
+					}
+					switch {
+					case e.Link != "":
+						e.Type = "link"
+					case fo.Permissions.IsRegular():
+						e.Type = "file"
+					case fo.Permissions.IsDir():
+						e.Type = "dir"
+					}
+					err = enc.Encode(e)
+					if err != nil {
+						panic(err)
+					}
+					continue
+				}
 				switch {
+				case f.HardlinkTo() != "":
+					fmt.Printf("%s (link to %s)\n", f.Path(), f.HardlinkTo())
 				case f.Opts().Permissions.IsRegular():
 					fmt.Printf("%s (%d bytes)\n", f.Path(), n)
 				case f.Opts().Permissions.IsDir():
@@ -92,21 +400,55 @@ func main() {
 				panic(err)
 			}
 		} else {
-			err = filestream.DecodeFiles(d, filestream.DecodeOptions{
+			dopts := filestream.DecodeOptions{
 				Base:                base,
 				PreservePermissions: perms,
 				PreserveUser:        users,
 				PreserveGroup:       groups,
-			})
+			}
+			if verbose {
+				dopts.OnEntry = func(path string, opts filestream.FileOptions, size int64) {
+					count++
+					if opts.Permissions.IsRegular() {
+						fmt.Fprintf(os.Stderr, "%s (%d bytes)\n", path, size)
+					} else {
+						fmt.Fprintln(os.Stderr, path)
+					}
+				}
+			}
+			err = filestream.DecodeFiles(d, dopts)
 			if err != nil {
 				panic(err)
 			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "decoded %d entries\n", count)
+			}
 		}
 		err = sr.Close()
 		if err != nil {
 			panic(err)
 		}
 	} else {
+		paths, err := expandArgs(flag.Args())
+		if err != nil {
+			panic(err)
+		}
+
+		// check the compression options before starting the stream
+		if sopts.Compression == "auto" {
+			sopts.Compression, err = autoCompression(paths)
+			if err != nil {
+				panic(err)
+			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "selected compression %q\n", sopts.Compression)
+			}
+		}
+		_, err = filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{Compression: sopts.Compression, CompressionLevel: sopts.CompressionLevel})
+		if err != nil {
+			panic(fmt.Errorf("invalid compression -z %q -l %d: %w", sopts.Compression, sopts.CompressionLevel, err))
+		}
+
 		var sw io.WriteCloser
 		if stream == "-" {
 			sw = os.Stdout
@@ -122,21 +464,41 @@ func main() {
 					panic(err)
 				}
 				sw = f
+			case "http", "https":
+				up, err := upload(method, u.String())
+				if err != nil {
+					panic(err)
+				}
+				sw = up
 			default:
 				panic(errors.New("unsupported url scheme"))
 			}
 		}
 		defer sw.Close()
-		w, err := filestream.NewWriter(sw, sopts)
+		var out io.Writer = sw
+		var bw *bufio.Writer
+		if bufSize > 0 {
+			bw = bufio.NewWriterSize(sw, bufSize)
+			out = bw
+		}
+		if verbose {
+			sopts.FileDone = func(path string, bytesWritten int64) {
+				count++
+				fmt.Fprintln(os.Stderr, path)
+			}
+		}
+		w, err := filestream.NewWriter(out, sopts)
 		if err != nil {
 			panic(err)
 		}
-		for _, v := range flag.Args() {
+		for _, v := range paths {
 			err = filestream.EncodeFiles(w, v, filestream.EncodeOptions{
 				Base:               base,
 				IncludePermissions: perms,
 				IncludeUser:        users,
 				IncludeGroup:       groups,
+				Exclude:            exclude,
+				Include:            include,
 			})
 			if err != nil {
 				panic(err)
@@ -146,6 +508,15 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "encoded %d entries\n", count)
+		}
+		if bw != nil {
+			err = bw.Flush()
+			if err != nil {
+				panic(err)
+			}
+		}
 		err = sw.Close()
 		if err != nil {
 			panic(err)
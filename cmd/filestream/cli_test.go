@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestDownloadResume(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt": bytes.Repeat([]byte("a"), 100000),
+		"b.txt": bytes.Repeat([]byte("b"), 100000),
+	}
+	dat, err := filestream.EncodeToBytes(files, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Now()
+
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Range"))
+		if len(requests) > 1 {
+			http.ServeContent(w, r, "stream", modtime, bytes.NewReader(dat))
+			return
+		}
+
+		// drop the connection partway through the first download
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(dat)))
+		w.Write(dat[:len(dat)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	dl, err := download(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	r, err := filestream.NewReader(dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]byte{}
+	for r.Next() {
+		body, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[r.File().Path()] = body
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(files, got); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+	if len(requests) != 2 || !strings.HasPrefix(requests[1], "bytes=") {
+		t.Errorf("expected a single range request but got %q", requests)
+	}
+}
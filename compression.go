@@ -1,26 +1,225 @@
 package filestream
 
 import (
+	"bufio"
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 
+	"github.com/andybalholm/brotli"
 	"github.com/pierrec/lz4"
 )
 
-func decompress(algo string, src io.Reader) (io.ReadCloser, error) {
+// decompress creates a decompressor which reads from src.
+// The decompressor reads through the returned bufio.Reader (which is src itself if it is already a bufio.Reader).
+// The gzip and lz4 decompressors stop at the end of the compressed data (unless gzip multistream decoding finds another stream), so data following the compressed region can be read from the bufio.Reader once decompression completes.
+// The brotli decompressor reads ahead, and fails if it reads data past the end of the compressed data.
+func decompress(algo string, src io.Reader) (io.ReadCloser, *bufio.Reader, error) {
+	br, ok := src.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(src)
+	}
+
+	var z io.ReadCloser
+	var err error
 	switch algo {
 	case "gzip":
-		return gzip.NewReader(src)
+		z, err = gzip.NewReader(br)
 	case "lz4":
-		return ioutil.NopCloser(lz4.NewReader(src)), nil
+		z = ioutil.NopCloser(lz4.NewReader(&lz4FrameReader{src: br}))
+	case "brotli":
+		z = ioutil.NopCloser(brotli.NewReader(br))
 	default:
-		return nil, errors.New("unsupported compression algorithm")
+		return nil, nil, errors.New("unsupported compression algorithm")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return z, br, nil
+}
+
+// lz4FrameReader passes through lz4 frames from a buffered reader, and reports EOF once the data after a frame is not another frame.
+// After each frame, the lz4 decoder reads ahead to check for another frame, which would otherwise consume the data following the compressed region.
+// The lz4 writer ends a frame on each flush, so a stream may consist of several frames.
+type lz4FrameReader struct {
+	src *bufio.Reader
+
+	// rem is the remaining length of the current section of the frame
+	rem int
+
+	// flags are the flags from the frame descriptor
+	flags byte
+
+	// state is the next section of the frame
+	state lz4FrameState
+}
+
+// lz4FrameState is a section of an lz4 frame.
+type lz4FrameState uint8
+
+const (
+	lz4FrameHeader lz4FrameState = iota
+	lz4FrameBlock
+	lz4FrameEnd
+)
+
+// lz4FrameMagic is the magic number at the start of an lz4 frame.
+const lz4FrameMagic = 0x184D2204
+
+// lz4 frame descriptor flags
+const (
+	lz4FlagBlockChecksum   = 1 << 4
+	lz4FlagContentSize     = 1 << 3
+	lz4FlagContentChecksum = 1 << 2
+	lz4FlagDictID          = 1 << 0
+)
+
+func (fr *lz4FrameReader) Read(dst []byte) (int, error) {
+	if fr.rem == 0 {
+		err := fr.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(dst) > fr.rem {
+		dst = dst[:fr.rem]
+	}
+	n, err := fr.src.Read(dst)
+	fr.rem -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next finds the length of the next section of the frame.
+func (fr *lz4FrameReader) next() error {
+	switch fr.state {
+	case lz4FrameHeader:
+		// magic number, flags, block descriptor, optional content size and dictionary ID, and header checksum
+		hdr, err := fr.src.Peek(5)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		fr.flags = hdr[4]
+		fr.rem = 4 + 3
+		if fr.flags&lz4FlagContentSize != 0 {
+			fr.rem += 8
+		}
+		if fr.flags&lz4FlagDictID != 0 {
+			fr.rem += 4
+		}
+		fr.state = lz4FrameBlock
+	case lz4FrameBlock:
+		// block size, block data, and optional block checksum
+		dat, err := fr.src.Peek(4)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		size := binary.LittleEndian.Uint32(dat)
+		fr.rem = 4
+		if size == 0 {
+			// end mark, and optional content checksum
+			if fr.flags&lz4FlagContentChecksum != 0 {
+				fr.rem += 4
+			}
+			fr.state = lz4FrameEnd
+			return nil
+		}
+		fr.rem += int(size &^ (1 << 31))
+		if fr.flags&lz4FlagBlockChecksum != 0 {
+			fr.rem += 4
+		}
+	case lz4FrameEnd:
+		// continue if another frame follows
+		magic, err := fr.src.Peek(4)
+		switch {
+		case err == io.EOF:
+			return io.EOF
+		case err != nil:
+			return err
+		case binary.LittleEndian.Uint32(magic) != lz4FrameMagic:
+			return io.EOF
+		}
+		fr.state = lz4FrameHeader
+		return fr.next()
 	}
+	return nil
 }
 
-func compress(algo string, level int, dst io.Writer) (io.WriteCloser, error) {
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ErrInvalidCompressionLevel indicates that a compression level is outside of the range supported by the algorithm.
+var ErrInvalidCompressionLevel = errors.New("invalid compression level")
+
+// lz4MaxLevel is the largest lz4 compression level, which is the maximum search depth of high compression mode.
+const lz4MaxLevel = 1 << 16
+
+// checkLevel checks that a compression level is in the supported range of a built-in algorithm.
+// A level of 0 always selects the default.
+func checkLevel(algo string, level int) error {
+	var min, max int
+	switch algo {
+	case "gzip":
+		min, max = gzip.HuffmanOnly, gzip.BestCompression
+	case "lz4":
+		min, max = 0, lz4MaxLevel
+	case "brotli":
+		min, max = 0, brotli.BestCompression
+	default:
+		return nil
+	}
+	if level < min || level > max {
+		return fmt.Errorf("%w: %s level %d (valid range: %d to %d)", ErrInvalidCompressionLevel, algo, level, min, max)
+	}
+	return nil
+}
+
+// LZ4Options are options for the lz4 frame format.
+type LZ4Options struct {
+	// BlockChecksum is whether to follow each compressed block with a checksum, so that corruption is detected as each block is read.
+	BlockChecksum bool
+
+	// NoContentChecksum is whether to omit the checksum of the uncompressed data at the end of each frame.
+	// The content checksum is included by default.
+	NoContentChecksum bool
+
+	// BlockSize is the maximum size of the uncompressed data in each block.
+	// It must be 64 KiB, 256 KiB, 1 MiB, or 4 MiB, and defaults to 4 MiB.
+	// Smaller blocks use less memory when compressing and decompressing, at some cost to the compression ratio.
+	BlockSize int
+}
+
+// check checks that the options are supported.
+func (o *LZ4Options) check() error {
+	if o == nil {
+		return nil
+	}
+	switch o.BlockSize {
+	case 0, 64 << 10, 256 << 10, 1 << 20, 4 << 20:
+		return nil
+	default:
+		return fmt.Errorf("unsupported lz4 block size %d", o.BlockSize)
+	}
+}
+
+// compress creates a compressor which writes to dst.
+// The lz4 options are only used with lz4, and may be nil.
+func compress(algo string, level int, lz4opts *LZ4Options, dst io.Writer) (io.WriteCloser, error) {
+	err := checkLevel(algo, level)
+	if err != nil {
+		return nil, err
+	}
+
 	switch algo {
 	case "gzip":
 		if level == 0 {
@@ -28,10 +227,64 @@ func compress(algo string, level int, dst io.Writer) (io.WriteCloser, error) {
 		}
 		return gzip.NewWriterLevel(dst, level)
 	case "lz4":
-		w := lz4.NewWriter(dst)
-		w.Header.CompressionLevel = level
+		err := lz4opts.check()
+		if err != nil {
+			return nil, err
+		}
+		w := &lz4Writer{Writer: lz4.NewWriter(dst), dst: dst, level: level, opts: lz4opts}
+		w.setHeader()
 		return w, nil
+	case "brotli":
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(dst, level), nil
 	default:
 		return nil, errors.New("unsupported compression algorithm")
 	}
 }
+
+// lz4Writer is an LZ4 compressor which can be flushed.
+// The Flush method of the LZ4 library does not clear the block buffer, so instead a flush ends the frame and starts a new one.
+// The reader decodes concatenated frames as a single stream.
+type lz4Writer struct {
+	*lz4.Writer
+	dst     io.Writer
+	level   int
+	opts    *LZ4Options
+	pending bool
+}
+
+// setHeader applies the options to the header of the next frame.
+func (w *lz4Writer) setHeader() {
+	w.Header.CompressionLevel = w.level
+	if w.opts != nil {
+		w.Header.BlockChecksum = w.opts.BlockChecksum
+		w.Header.NoChecksum = w.opts.NoContentChecksum
+		if w.opts.BlockSize != 0 {
+			w.Header.BlockMaxSize = w.opts.BlockSize
+		}
+	}
+}
+
+func (w *lz4Writer) Write(dat []byte) (int, error) {
+	if len(dat) > 0 {
+		w.pending = true
+	}
+	return w.Writer.Write(dat)
+}
+
+// Flush ends the current frame if any data has been written to it.
+func (w *lz4Writer) Flush() error {
+	if !w.pending {
+		return nil
+	}
+	err := w.Writer.Close()
+	if err != nil {
+		return err
+	}
+	w.Writer.Reset(w.dst)
+	w.setHeader()
+	w.pending = false
+	return nil
+}
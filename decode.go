@@ -2,78 +2,412 @@ package filestream
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"strconv"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
 )
 
-const fmtVersion = 0
+// ReaderOptions are configuration options for a Reader.
+type ReaderOptions struct {
+	// SkipCorruptFiles is whether to attempt to recover from corrupt files.
+	// When a file is found to be corrupt, the next call to Next will scan forward for the next plausible file header and continue from there.
+	// Corruption within file data can only be detected in streams written with checksums enabled.
+	// Recovery is best-effort, and is not possible if the corruption is within a compressed region.
+	SkipCorruptFiles bool
+
+	// OnCorruptFile is an optional callback which is invoked when a corrupt file is skipped.
+	// The path will be empty if the header of the file was corrupt.
+	OnCorruptFile func(path string, err error)
+
+	// Encryption is the key or passphrase used to decrypt an encrypted stream.
+	// If this is set, the stream must be encrypted.
+	Encryption *Encryption
+
+	// AllowTrailingData is whether to tolerate data after the end of the stream.
+	// By default, data after the end of the stream is treated as an error.
+	// If this is set, the trailing data is left unread, and can be obtained with Reader.Remaining.
+	// Gzip multistream decoding is disabled, so that a following gzip stream is not consumed.
+	// Trailing data after an lz4-compressed stream must not start with another lz4 frame, as it would be decoded as part of the stream.
+	// Trailing data is not supported after a brotli-compressed stream, as the brotli decoder reads ahead of the compressed data.
+	AllowTrailingData bool
+
+	// OnHeader is an optional callback for debugging, which is invoked with the raw encoded form of each header before it is parsed.
+	// This includes the stream header, each file header, and the terminating header.
+	// The data includes the null terminator, and is a copy which the callback may retain.
+	OnHeader func(raw []byte)
+
+	// BufferSize is the size of the buffers used to read the stream, in bytes.
+	// Larger buffers read data in fewer, larger reads, which may improve throughput over high-latency links.
+	// It must be at least 512 bytes, and defaults to 4096 bytes.
+	BufferSize int
+
+	// MaxChunkSize is the largest chunk length which may be declared in the body of a file.
+	// Longer chunks fail with ErrChunkTooLarge, and are treated as corruption.
+	// Files written with FileN or WriteFile are sent as a single chunk, so this must be at least the size of the largest such file.
+	// Defaults to 1 TiB.
+	MaxChunkSize int64
+
+	// GzipSingleMember is whether to read only the first member of a gzip-compressed stream.
+	// By default, concatenated gzip members are decoded as one continuous stream (as with gzip -d), so that streams compressed by external tools in pieces can be read.
+	// If this is set, the stream must end within the first member, and any following members are treated as trailing data, which is rejected unless AllowTrailingData is set.
+	// AllowTrailingData implies this option.
+	GzipSingleMember bool
+}
+
+// ErrFileNotConsumed indicates that Next was called before the body of the previous file was completely read.
+var ErrFileNotConsumed = errors.New("requested next file before finishing previous")
+
+// ErrChecksum indicates that a chunk of file data did not match its checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrMalformedChunk indicates that the framing of a chunk in the body of a file (its length or checksum) could not be parsed.
+var ErrMalformedChunk = errors.New("malformed chunk")
+
+// ErrChunkTooLarge indicates that a chunk in the body of a file declared a length greater than the maximum chunk size.
+var ErrChunkTooLarge = errors.New("chunk too large")
+
+// defaultMaxChunkSize is the default maximum chunk length.
+const defaultMaxChunkSize = 1 << 40
+
+// ErrDeadlineUnsupported indicates that a deadline was set on a Reader whose source does not support deadlines.
+var ErrDeadlineUnsupported = errors.New("source does not support read deadlines")
 
 // Reader is a filestream reader.
 type Reader struct {
+	// opts are the options used to configure the reader
+	opts ReaderOptions
+
 	// ready is whether we are ready to read another file header
 	ready bool
 
 	// closed is whether the reader has completed
 	closed bool
 
+	// hdr is the header of the stream
+	hdr streamHeader
+
+	// checksums is whether chunks are followed by checksums
+	checksums bool
+
+	// varint is whether chunk lengths and checksums are encoded as varints
+	varint bool
+
+	// raw is whether file bodies are returned with their framing
+	raw bool
+
+	// corrupt is the file which was found to be corrupt, if any
+	corrupt *corruptFile
+
 	// stream is the decompressed data stream
-	stream bufio.Reader
+	stream *bufio.Reader
+
+	// src is the buffered source, which is the same as stream if the stream is not compressed or encrypted
+	src *bufio.Reader
+
+	// zsrc is the buffered input of the decompressor, which is positioned after the compressed region once decompression completes
+	// It is the same as src unless the stream is encrypted, and the same as stream if the stream is not compressed.
+	zsrc *bufio.Reader
+
+	// srcCount counts the data read from the source
+	srcCount *countingReader
+
+	// count counts the data read into the stream
+	count *countingReader
 
 	// closer is the io.Closer used to be closed after read completed
 	closer io.Closer
 
+	// peeked is the next file header, if it has been read by Peek
+	peeked *peekedHeader
+
+	// filter selects the entries returned by Next and Peek, if set
+	filter func(*FileHeader) bool
+
+	// stats are the totals of data read so far
+	stats Stats
+
+	// maxChunkSize is the largest chunk length which is accepted
+	maxChunkSize int64
+
+	// manifest is the manifest of the stream, if it has one
+	manifest *Manifest
+
+	// end is the offset of the stream terminator, once it has been read
+	end int64
+
 	// stored reader or error from call to Next
 	fr  *FileReader
 	err error
 }
 
+// corruptFile is a file which could not be read due to corruption.
+type corruptFile struct {
+	path string
+	err  error
+}
+
 // NewReader creates a new Reader which reads from the source.
 func NewReader(src io.Reader) (*Reader, error) {
-	br := bufio.NewReader(src)
+	return NewReaderWithOptions(src, ReaderOptions{})
+}
+
+// NewReaderWithOptions creates a new Reader which reads from the source using the given options.
+func NewReaderWithOptions(src io.Reader, opts ReaderOptions) (*Reader, error) {
+	return newReader(src, opts, false)
+}
+
+// NewRawReader creates a new Reader which returns the framed chunks of each file verbatim.
+// Reading from a FileReader returns the chunk lengths, data, and checksums of the body exactly as a Writer would have written them, and bodies are never decompressed.
+// Checksums are still verified as the body is read.
+// This is intended for relaying files between streams with Writer.CopyRaw, without a decompress/recompress cycle.
+// The returned bytes are only meaningful when re-fed into a stream with the same framing, and a body with per-file compression is only meaningful with the same compression.
+// A stream with stream-level compression or encryption is still decompressed and decrypted, since the headers are inside of it.
+func NewRawReader(src io.Reader, opts ReaderOptions) (*Reader, error) {
+	return newReader(src, opts, true)
+}
+
+func newReader(src io.Reader, opts ReaderOptions, raw bool) (*Reader, error) {
+	err := checkBufferSize(opts.BufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	count := &countingReader{r: src}
+	r := &Reader{
+		opts:         opts,
+		raw:          raw,
+		src:          bufio.NewReaderSize(count, bufferSize(opts.BufferSize)),
+		srcCount:     count,
+		maxChunkSize: opts.MaxChunkSize,
+	}
+	if r.maxChunkSize <= 0 {
+		r.maxChunkSize = defaultMaxChunkSize
+	}
+
+	err = r.start()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewReaderFromBytes creates a new Reader which reads a stream held in memory.
+// The stream header is parsed directly from the slice rather than being copied through a buffer, and the remainder of the stream is read through a buffer no larger than it needs to be.
+// The data must not be modified while the Reader is in use.
+func NewReaderFromBytes(data []byte) (*Reader, error) {
+	end := bytes.IndexByte(data, '\x00')
+	if end < 0 {
+		return nil, io.EOF
+	}
+	jd, body := data[:end+1], data[end+1:]
 
-	jd, err := br.ReadString('\x00')
+	size := len(body)
+	switch {
+	case size < minBufferSize:
+		size = minBufferSize
+	case size > defaultBufferSize:
+		size = defaultBufferSize
+	}
+
+	count := &countingReader{r: bytes.NewReader(body), n: int64(len(jd))}
+	r := &Reader{
+		src:          bufio.NewReaderSize(count, size),
+		srcCount:     count,
+		maxChunkSize: defaultMaxChunkSize,
+	}
+
+	err := r.startHeader(jd)
 	if err != nil {
 		return nil, err
 	}
+
+	return r, nil
+}
+
+// start reads a stream header from the source and prepares to read the files of the stream.
+func (r *Reader) start() error {
+	jd, err := r.src.ReadBytes('\x00')
+	if err != nil {
+		return err
+	}
+
+	return r.startHeader(jd)
+}
+
+// startHeader parses a stream header, including its null terminator, and prepares to read the files of the stream from the source.
+func (r *Reader) startHeader(jd []byte) error {
+	br := r.src
+
+	r.stats.HeaderBytes += int64(len(jd))
+	if r.opts.OnHeader != nil {
+		r.opts.OnHeader(jd)
+	}
 	jd = jd[:len(jd)-1] // remove trailing null character
 
 	var hdr streamHeader
-	err = json.Unmarshal([]byte(jd), &hdr)
+	err := json.Unmarshal(jd, &hdr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if hdr.Version > fmtVersion {
-		return nil, fmt.Errorf("filestream v%d format not supported (max supported: v%d)", hdr.Version, fmtVersion)
+		return fmt.Errorf("filestream v%d format not supported (max supported: v%d)", hdr.Version, fmtVersion)
+	}
+
+	switch hdr.Checksum {
+	case "", "crc32":
+	default:
+		return fmt.Errorf("unsupported checksum algorithm %q", hdr.Checksum)
+	}
+
+	switch hdr.Framing {
+	case "", "varint":
+	default:
+		return fmt.Errorf("unsupported framing %q", hdr.Framing)
+	}
+
+	var body io.Reader = br
+	switch {
+	case hdr.Encryption != nil:
+		aead, err := openEncryption(r.opts.Encryption, hdr.Encryption)
+		if err != nil {
+			return err
+		}
+		body = newDecryptReader(br, aead, hdr.Encryption.Nonce)
+	case r.opts.Encryption != nil:
+		return errors.New("stream is not encrypted")
 	}
 
 	var closer io.Closer
-	var stream io.Reader = br
+	var zsrc *bufio.Reader
 	if hdr.Compression != "" {
-		zr, err := decompress(hdr.Compression, br)
+		// data following the compressed region is read from zsrc, which the decompressor does not read past
+		var zr io.ReadCloser
+		zr, zsrc, err = decompress(hdr.Compression, body)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		stream = zr
+		if gz, ok := zr.(*gzip.Reader); ok && (r.opts.AllowTrailingData || r.opts.GzipSingleMember) {
+			gz.Multistream(false)
+		}
+		body = zr
 		closer = zr
 	}
 
-	r := &Reader{
-		stream: *bufio.NewReader(stream),
-		ready:  true,
-		closer: closer,
+	count, stream := r.srcCount, br
+	if body != br {
+		count = &countingReader{r: body}
+		stream = bufio.NewReaderSize(count, bufferSize(r.opts.BufferSize))
+	}
+	if zsrc == nil {
+		zsrc = stream
 	}
 
-	return r, nil
+	r.hdr = hdr
+	r.stream, r.zsrc, r.count, r.closer = stream, zsrc, count, closer
+	r.checksums = hdr.Checksum != ""
+	r.varint = hdr.Framing == "varint"
+	r.ready, r.closed, r.corrupt = true, false, nil
+
+	r.manifest = nil
+	if hdr.Manifest {
+		return r.readManifest()
+	}
+
+	return nil
+}
+
+// Version returns the format version of the stream.
+func (r *Reader) Version() int {
+	return r.hdr.Version
+}
+
+// Compression returns the compression algorithm of the stream, or an empty string if the stream is not compressed.
+func (r *Reader) Compression() string {
+	return r.hdr.Compression
+}
+
+// Metadata returns the application-specific metadata of the stream, or nil if there is none.
+func (r *Reader) Metadata() map[string]string {
+	return r.hdr.Metadata
+}
+
+// NextStream starts reading the next of several streams which have been concatenated in the source.
+// It may only be called after Next has returned false without an error, and requires ReaderOptions.AllowTrailingData.
+// If there are no more streams in the source, it returns false with no error.
+// Otherwise, files in the new stream can be read with Next.
+// For uncompressed streams, file offsets are relative to the start of the source rather than the start of the stream.
+func (r *Reader) NextStream() (bool, error) {
+	if !r.opts.AllowTrailingData {
+		return false, errors.New("reading multiple streams requires AllowTrailingData")
+	}
+	if !r.closed || r.err != nil {
+		return false, errors.New("previous stream has not been completed")
+	}
+
+	// skip the rest of the encrypted region
+	if r.zsrc != r.src {
+		_, err := io.Copy(ioutil.Discard, r.zsrc)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// check for the end of the source
+	_, err := r.src.Peek(1)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = r.start()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 // Next checks if there is another file available.
 // On error, this will return false, and a call to .Err() will return the error.
 // The file can be obtained by calling .File()
+// If a filter has been set with Filter, entries which do not match are skipped.
 func (r *Reader) Next() bool {
+	for r.next() {
+		if r.filter == nil || r.filter(&r.fr.FileHeader) {
+			return true
+		}
+		err := r.fr.Skip()
+		if err != nil {
+			r.fr, r.err = nil, err
+			return false
+		}
+	}
+	return false
+}
+
+// Filter sets a filter which selects the entries returned by Next and Peek.
+// Entries for which the filter returns false are skipped, along with their bodies.
+// This may be used to read only the directories of a stream, for example.
+// Passing nil removes the filter.
+func (r *Reader) Filter(filter func(*FileHeader) bool) {
+	r.filter = filter
+}
+
+// next advances to the next entry in the stream, regardless of the filter.
+func (r *Reader) next() bool {
 	r.fr, r.err = nil, nil
 
 	defer func() {
@@ -86,36 +420,59 @@ func (r *Reader) Next() bool {
 		return false
 	}
 
-	if !r.ready {
-		r.err = errors.New("requested next file before finishing previous")
+	if r.peeked == nil && !r.ready && (r.corrupt == nil || !r.opts.SkipCorruptFiles) {
+		r.err = ErrFileNotConsumed
 		return false
 	}
 
 	r.ready = false
 
-	jd, err := r.stream.ReadString('\x00')
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-		r.err = err
-		return false
+	p := r.peeked
+	r.peeked = nil
+	if p == nil {
+		p = r.readHeader()
 	}
-	jd = jd[:len(jd)-1] // remove trailing null character
-
-	var hdr fileHeader
-	err = json.Unmarshal([]byte(jd), &hdr)
-	if err != nil {
-		r.err = err
+	if p.err != nil {
+		r.err = p.err
 		return false
 	}
+	hdr, offset := p.hdr, p.offset
+	r.stats.HeaderBytes += int64(p.size)
+
+	var err error
 
 	if hdr.Path == "\x00" {
 		r.closed = true
-		_, err = r.stream.Read([]byte{0})
-		if err != io.EOF {
-			r.err = errors.New("excess data")
-			return false
+		r.end = offset
+		if r.hdr.Index {
+			err = r.skipIndex()
+			if err != nil {
+				r.err = err
+				return false
+			}
+		}
+		switch {
+		case !r.opts.AllowTrailingData:
+			_, err = r.stream.Read([]byte{0})
+			if err == io.EOF && r.zsrc != r.stream {
+				// check for data after the compressed region
+				_, err = r.zsrc.Read([]byte{0})
+			}
+			if err == io.EOF && r.zsrc != r.src {
+				// check for data after the encrypted region
+				_, err = r.src.Read([]byte{0})
+			}
+			if err != io.EOF {
+				r.err = errors.New("excess data")
+				return false
+			}
+		case r.stream != r.zsrc:
+			// drain the decompressor so that zsrc is positioned after the compressed region
+			_, err = io.Copy(ioutil.Discard, r.stream)
+			if err != nil {
+				r.err = err
+				return false
+			}
 		}
 		if r.closer != nil {
 			err = r.closer.Close()
@@ -131,26 +488,253 @@ func (r *Reader) Next() bool {
 	}
 
 	r.fr = &FileReader{
-		reader: r,
-		hdr:    hdr,
+		FileHeader: FileHeader{hdr, offset},
+		reader:     r,
 	}
+	r.stats.Files++
 
-	if r.fr.IsDir() {
-		// dir should be zero length - read terminator
-		_, err = r.fr.Read(nil)
+	if !r.fr.hdr.Mode.IsRegular() || r.fr.HardlinkTo() != "" {
+		// dirs, special files, and hard links should be zero length - read terminator
+		_, err = r.fr.readRaw(nil)
 		if err == nil {
-			r.err = fmt.Errorf("expected empty body for directory %q but got body", hdr.Path)
+			r.err = fmt.Errorf("expected empty body for %q but got body", hdr.Path)
 			return false
 		}
 		if err != io.EOF {
 			r.err = err
 			return false
 		}
+		if r.raw {
+			r.fr.frame = appendNum(r.fr.num[:0], 0, r.varint)
+		}
 	}
 
 	return true
 }
 
+// skipIndex skips over the index which follows the terminator of an indexed stream.
+func (r *Reader) skipIndex() error {
+	_, err := r.stream.ReadString('\x00')
+	if err == nil {
+		_, err = r.stream.Discard(indexFooterSize)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	return nil
+}
+
+// Remaining returns a reader of the data following the end of the stream.
+// This is only meaningful with ReaderOptions.AllowTrailingData, after Next has returned false without an error.
+// Data buffered by the Reader is returned before the remainder of the source.
+// If the stream is encrypted, this starts with any decrypted data following the end of the stream, followed by the data after the encrypted region.
+func (r *Reader) Remaining() io.Reader {
+	if r.zsrc != r.src {
+		return io.MultiReader(r.zsrc, r.src)
+	}
+	return r.src
+}
+
+// Stats returns totals of the data read from the stream so far.
+// BodyBytes only includes file data which has been read, and not data which was skipped.
+// StreamBytes is the amount of data consumed from the source, excluding data which has been buffered but not yet used.
+func (r *Reader) Stats() Stats {
+	s := r.stats
+	s.StreamBytes = r.srcCount.n - int64(r.src.Buffered())
+	return s
+}
+
+// SetDeadline sets the read deadline of the underlying source, bounding how long Next and reads of file bodies may block.
+// This only works if the source has a SetReadDeadline method, such as a net.Conn, and returns ErrDeadlineUnsupported otherwise.
+// A zero value for t means reads will not time out.
+// Once a read has timed out, the error is sticky and the Reader cannot be used further.
+func (r *Reader) SetDeadline(t time.Time) error {
+	ds, ok := r.srcCount.r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return ErrDeadlineUnsupported
+	}
+	return ds.SetReadDeadline(t)
+}
+
+// Peek returns the header of the next entry without advancing to it, so that the next call to Next selects the same entry.
+// As with Next, the previous file must have been read completely.
+// Peeking again before calling Next returns the same header.
+// At the end of the stream, Peek returns io.EOF.
+// If a filter has been set with Filter, entries which do not match are skipped.
+func (r *Reader) Peek() (*FileHeader, error) {
+	for {
+		fh, err := r.peek()
+		if err != nil || r.filter == nil || r.filter(fh) {
+			return fh, err
+		}
+
+		// consume the entry which has been filtered out
+		if !r.next() {
+			if r.err != nil {
+				return nil, r.err
+			}
+			return nil, io.EOF
+		}
+		err = r.fr.Skip()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// peek reads the next header of the stream if it has not already been read, regardless of the filter.
+func (r *Reader) peek() (*FileHeader, error) {
+	if r.peeked == nil {
+		if r.closed {
+			return nil, io.EOF
+		}
+		if !r.ready && (r.corrupt == nil || !r.opts.SkipCorruptFiles) {
+			return nil, ErrFileNotConsumed
+		}
+		r.peeked = r.readHeader()
+	}
+
+	p := r.peeked
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.hdr.Path == "\x00" {
+		return nil, io.EOF
+	}
+	fh := p.FileHeader
+	return &fh, nil
+}
+
+// peekedHeader is a file header which has been read from the stream, but not yet processed by Next.
+type peekedHeader struct {
+	FileHeader
+
+	// size is the encoded size of the header
+	size int
+
+	// err is the error encountered while reading the header, if any
+	err error
+}
+
+// readHeader reads the next file header from the stream, and records where it started.
+func (r *Reader) readHeader() *peekedHeader {
+	hdr, size, err := r.nextHeader()
+	if err != nil {
+		return &peekedHeader{err: err}
+	}
+	return &peekedHeader{
+		FileHeader: FileHeader{hdr, r.offset() - int64(size)},
+		size:       size,
+	}
+}
+
+// offset returns the current offset into the stream.
+func (r *Reader) offset() int64 {
+	return r.count.n - int64(r.stream.Buffered())
+}
+
+// nextHeader reads the next file header from the stream.
+// It also returns the encoded size of the header.
+// If the reader is skipping corrupt files, corrupt data is skipped over.
+func (r *Reader) nextHeader() (fileHeader, int, error) {
+	if r.corrupt != nil {
+		return r.resync()
+	}
+
+	jd, err := r.stream.ReadString('\x00')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fileHeader{}, 0, err
+	}
+	size := len(jd)
+	if r.opts.OnHeader != nil {
+		r.opts.OnHeader([]byte(jd))
+	}
+	jd = jd[:len(jd)-1] // remove trailing null character
+
+	// an empty header is a compact terminator
+	if jd == "" && r.hdr.Version >= compactTerminatorVersion {
+		return fileHeader{Path: "\x00"}, size, nil
+	}
+
+	var hdr fileHeader
+	err = json.Unmarshal([]byte(jd), &hdr)
+	if err != nil {
+		if !r.opts.SkipCorruptFiles {
+			return fileHeader{}, 0, err
+		}
+		r.corrupt = &corruptFile{err: err}
+		return r.resync()
+	}
+
+	return hdr, size, nil
+}
+
+// headerPrefix is the prefix of every encoded file header.
+const headerPrefix = `{"path":`
+
+// resync reports the corrupt file and skips forward to the next plausible file header.
+func (r *Reader) resync() (fileHeader, int, error) {
+	c := r.corrupt
+	r.corrupt = nil
+	if r.opts.OnCorruptFile != nil {
+		r.opts.OnCorruptFile(c.path, c.err)
+	}
+
+	for {
+		// scan for the start of a header
+		matched := 0
+		for matched < len(headerPrefix) {
+			b, err := r.stream.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return fileHeader{}, 0, err
+			}
+			switch b {
+			case headerPrefix[matched]:
+				matched++
+			case headerPrefix[0]:
+				matched = 1
+			default:
+				matched = 0
+			}
+		}
+
+		jd, err := r.stream.ReadString('\x00')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fileHeader{}, 0, err
+		}
+		jd = headerPrefix + jd[:len(jd)-1]
+
+		// the real header may begin anywhere in the candidate, but must end at the null terminator
+		for i := 0; ; {
+			var hdr fileHeader
+			if json.Unmarshal([]byte(jd[i:]), &hdr) == nil {
+				if r.opts.OnHeader != nil {
+					r.opts.OnHeader([]byte(jd[i:] + "\x00"))
+				}
+				return hdr, len(jd) - i + 1, nil
+			}
+
+			j := strings.Index(jd[i+1:], headerPrefix)
+			if j < 0 {
+				break
+			}
+			i += j + 1
+		}
+	}
+}
+
 // File returns the currently selected file.
 // File must be read completely before calling Next again.
 // Directories do not need to be read, and have no body.
@@ -166,65 +750,275 @@ func (r *Reader) Err() error {
 
 // FileReader is a reader of a single file in a stream.
 type FileReader struct {
+	FileHeader
+
 	// reader is the parent
 	reader *Reader
 
-	// hdr is the file header
-	hdr fileHeader
-
 	// done is whether the end of the file has been reached
 	done bool
 
 	// chunkRem is the remaining size of the current chunk
 	chunkRem int
+
+	// holeRem is the remaining size of the current hole
+	holeRem int64
+
+	// crc is the checksum of the data read from the current chunk
+	crc uint32
+
+	// z is the decompressor for the file body, if the file is compressed
+	z io.Reader
+
+	// zsrc is the source of the decompressor, which holds any data after the compressed body
+	zsrc *bufio.Reader
+
+	// frame is framing which has been read in raw mode but not yet returned
+	frame []byte
+
+	// sumPending is whether a checksum follows the current chunk in raw mode
+	sumPending bool
+
+	// num is space for framing in raw mode
+	num [binary.MaxVarintLen64 + 1]byte
+}
+
+// FileHeader is a read-only view of the header of an entry in a stream.
+type FileHeader struct {
+	// hdr is the file header
+	hdr fileHeader
+
+	// offset is the offset of the file header in the stream
+	offset int64
 }
 
 // Path is the path of the file.
-func (fr *FileReader) Path() string {
-	return fr.hdr.Path
+func (fh *FileHeader) Path() string {
+	return fh.hdr.Path
 }
 
 // IsDir returns whether the entry is a directory.
-func (fr *FileReader) IsDir() bool {
-	return fr.hdr.Mode.IsDir()
+func (fh *FileHeader) IsDir() bool {
+	return fh.hdr.Mode.IsDir()
+}
+
+// HardlinkTo returns the path of the file which this entry is a hard link to.
+// If the entry is not a hard link, this returns an empty string.
+func (fh *FileHeader) HardlinkTo() string {
+	return fh.hdr.HardlinkTo
+}
+
+// Device returns the major and minor device numbers of a device node.
+// These are zero for other types of files.
+func (fh *FileHeader) Device() (major, minor uint32) {
+	return fh.hdr.Major, fh.hdr.Minor
+}
+
+// Offset returns the offset of the file's header within the stream.
+// For uncompressed streams, this is the byte offset in the source, and can be used to build an index of the stream.
+// For compressed or encrypted streams, this is the offset within the decompressed and decrypted data.
+func (fh *FileHeader) Offset() int64 {
+	return fh.offset
+}
+
+// Size returns the expected size of the file body.
+// The size is only available if the writer knew it ahead of time, and is otherwise reported as not present.
+// This is a hint for pre-allocation and progress reporting, and may not match the actual body.
+func (fh *FileHeader) Size() (int64, bool) {
+	if fh.hdr.Size == nil {
+		return 0, false
+	}
+	return *fh.hdr.Size, true
 }
 
 // Opts are the options of the file.
-func (fr *FileReader) Opts() FileOptions {
+func (fh *FileHeader) Opts() FileOptions {
 	return FileOptions{
-		Permissions: fr.hdr.Mode,
-		User:        fr.hdr.User,
-		Group:       fr.hdr.Group,
+		Permissions:      fh.hdr.Mode,
+		ExactPermissions: fh.hdr.ExactMode,
+		User:             fh.hdr.User,
+		Group:            fh.hdr.Group,
+		Compression:      fh.hdr.Compression,
+		Xattrs:           fh.hdr.Xattrs,
+		Extra:            fh.hdr.Extra,
+		ContentType:      fh.hdr.ContentType,
 	}
 }
 
-func (fr *FileReader) Read(dst []byte) (n int, err error) {
-	if fr.done {
-		return 0, io.EOF
+// ContentType returns the MIME type of the file body.
+// If the type was not recorded in the stream, this returns an empty string.
+func (fh *FileHeader) ContentType() string {
+	return fh.hdr.ContentType
+}
+
+func (fr *FileReader) Read(dst []byte) (int, error) {
+	if fr.reader.raw {
+		return fr.readFramed(dst)
 	}
 
-	if fr.chunkRem == 0 {
-		lstr, err := fr.reader.stream.ReadString('\x00')
+	n, err := fr.read(dst)
+	fr.reader.stats.BodyBytes += int64(n)
+	return n, err
+}
+
+// read reads the body of the file, decompressing it if necessary.
+func (fr *FileReader) read(dst []byte) (int, error) {
+	if fr.hdr.Compression == "" {
+		return fr.readRaw(dst)
+	}
+
+	if fr.z == nil {
+		z, zsrc, err := decompress(fr.hdr.Compression, rawBody{fr})
 		if err != nil {
-			if err == io.EOF {
-				err = io.ErrUnexpectedEOF
-			}
 			return 0, err
 		}
-		lstr = lstr[:len(lstr)-1]
+		if gz, ok := z.(*gzip.Reader); ok {
+			// file bodies are a single gzip stream
+			gz.Multistream(false)
+		}
+		fr.z, fr.zsrc = z, zsrc
+	}
+
+	n, err := fr.z.Read(dst)
+	if err == io.EOF {
+		// the body must end with the compressed data
+		_, rerr := fr.zsrc.ReadByte()
+		if rerr == nil {
+			rerr = errors.New("excess data after compressed file body")
+		}
+		err = rerr
+	}
 
-		l, err := strconv.Atoi(lstr)
+	return n, err
+}
+
+// WriteTo writes the remainder of the file body to w.
+// This allows io.Copy to write chunks of the body directly from the buffer of the stream, rather than copying them through an intermediate buffer.
+// Compressed bodies and raw readers are copied through a buffer as usual.
+func (fr *FileReader) WriteTo(w io.Writer) (int64, error) {
+	if fr.reader.raw || fr.hdr.Compression != "" {
+		return io.Copy(w, struct{ io.Reader }{fr}) // hide WriteTo to avoid recursion
+	}
+
+	var total int64
+	for !fr.done {
+		if fr.chunkRem == 0 && fr.holeRem == 0 {
+			err := fr.nextChunk()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return total, err
+			}
+		}
+
+		n, err := fr.writeChunk(w)
+		total += int64(n)
+		fr.reader.stats.BodyBytes += int64(n)
 		if err != nil {
-			return 0, err
+			return total, err
 		}
+	}
 
-		if l == 0 {
-			fr.done = true
-			fr.reader.ready = true
-			return 0, io.EOF
+	return total, nil
+}
+
+// writeChunk writes the remainder of the current chunk or hole to w.
+func (fr *FileReader) writeChunk(w io.Writer) (int, error) {
+	var total int
+
+	// holes are not followed by a checksum
+	check := fr.reader.checksums && fr.chunkRem > 0
+
+	// fill holes with zeros
+	for fr.holeRem > 0 {
+		dat := zeroBlock[:]
+		if int64(len(dat)) > fr.holeRem {
+			dat = dat[:fr.holeRem]
+		}
+		n, err := w.Write(dat)
+		total += n
+		fr.holeRem -= int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	// write data directly from the stream buffer
+	stream := fr.reader.stream
+	for fr.chunkRem > 0 {
+		size := fr.chunkRem
+		if size > stream.Size() {
+			size = stream.Size()
+		}
+		dat, perr := stream.Peek(size)
+		n, err := w.Write(dat)
+		total += n
+		fr.chunkRem -= n
+		if fr.reader.checksums {
+			fr.crc = crc32.Update(fr.crc, crc32.IEEETable, dat[:n])
+		}
+		_, derr := stream.Discard(n)
+		switch {
+		case err != nil:
+			return total, err
+		case derr != nil:
+			return total, derr
+		case perr != nil:
+			if perr == io.EOF {
+				perr = io.ErrUnexpectedEOF
+			}
+			return total, perr
+		}
+	}
+	if check {
+		return total, fr.checkChunk()
+	}
+
+	return total, nil
+}
+
+// RawBody returns a reader for the body of the file as it is stored in the stream.
+// If the file uses per-file compression, the data is not decompressed.
+// This allows compressed files to be passed along without recompressing them.
+// A file should be read either through RawBody or through Read, but not both.
+func (fr *FileReader) RawBody() io.Reader {
+	return rawBody{fr}
+}
+
+// rawBody is an io.Reader for the stored body of a file.
+type rawBody struct {
+	fr *FileReader
+}
+
+func (rb rawBody) Read(dst []byte) (int, error) {
+	return rb.fr.readRaw(dst)
+}
+
+// readRaw reads the stored body of the file.
+func (fr *FileReader) readRaw(dst []byte) (n int, err error) {
+	if fr.done {
+		return 0, io.EOF
+	}
+
+	if fr.chunkRem == 0 && fr.holeRem == 0 {
+		err := fr.nextChunk()
+		if err != nil {
+			return 0, err
 		}
+	}
 
-		fr.chunkRem = l
+	// fill holes with zeros
+	if fr.holeRem > 0 {
+		n = len(dst)
+		if int64(n) > fr.holeRem {
+			n = int(fr.holeRem)
+		}
+		for i := range dst[:n] {
+			dst[i] = 0
+		}
+		fr.holeRem -= int64(n)
+		return n, nil
 	}
 
 	n = fr.chunkRem
@@ -240,5 +1034,272 @@ func (fr *FileReader) Read(dst []byte) (n int, err error) {
 		err = io.ErrUnexpectedEOF
 	}
 
+	if fr.reader.checksums {
+		fr.crc = crc32.Update(fr.crc, crc32.IEEETable, dst[:n])
+		if fr.chunkRem == 0 && err == nil {
+			err = fr.checkChunk()
+		}
+	}
+
+	return n, err
+}
+
+// nextChunk reads the length of the next chunk of the body, or the length of a hole.
+// If the end of the body has been reached, this returns io.EOF.
+func (fr *FileReader) nextChunk() error {
+	l, err := fr.readNum(holeChunk)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case l == 0:
+		fr.done = true
+		fr.reader.ready = true
+		return io.EOF
+	case l == holeChunk:
+		n, err := fr.readHole()
+		if err != nil {
+			return err
+		}
+		fr.holeRem = int64(n)
+		return nil
+	}
+	err = fr.checkChunkLength(l)
+	if err != nil {
+		return err
+	}
+
+	fr.chunkRem = int(l)
+
+	return nil
+}
+
+// readHole reads the length of a hole, after the hole marker.
+func (fr *FileReader) readHole() (uint64, error) {
+	if !fr.reader.hdr.Sparse {
+		return 0, fr.corrupted(errors.New("hole in a stream without sparse files"))
+	}
+	n, err := fr.readNum(holeChunk)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fr.corrupted(errors.New("empty hole"))
+	}
+	return n, nil
+}
+
+// Skip discards the remainder of the file body, so that the next file can be read.
+// Chunks are discarded without copying them, and checksums are not verified.
+// Skip is a no-op on directories.
+func (fr *FileReader) Skip() error {
+	if fr.reader.raw {
+		_, err := io.Copy(ioutil.Discard, fr)
+		return err
+	}
+
+	for !fr.done {
+		fr.holeRem = 0
+		if fr.chunkRem == 0 {
+			err := fr.nextChunk()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			if fr.chunkRem == 0 {
+				// skip over a hole
+				continue
+			}
+		}
+
+		n, err := fr.reader.stream.Discard(fr.chunkRem)
+		fr.chunkRem -= n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if fr.reader.checksums {
+			_, err = fr.readNum(math.MaxUint32)
+			if err != nil {
+				return err
+			}
+			fr.crc = 0
+		}
+	}
+
+	return nil
+}
+
+// checkChunk reads the checksum at the end of a chunk and compares it to the data which was read.
+func (fr *FileReader) checkChunk() error {
+	sum, err := fr.readNum(math.MaxUint32)
+	if err != nil {
+		return err
+	}
+	if uint32(sum) != fr.crc {
+		return fr.corrupted(ErrChecksum)
+	}
+	fr.crc = 0
+
+	return nil
+}
+
+// maxInt is the largest value of an int.
+const maxInt = uint64(^uint(0) >> 1)
+
+// checkChunkLength checks that a declared chunk length is within the limits of the reader.
+func (fr *FileReader) checkChunkLength(l uint64) error {
+	switch {
+	case l > uint64(fr.reader.maxChunkSize):
+		return fr.corrupted(fmt.Errorf("chunk length %d exceeds limit of %d: %w", l, fr.reader.maxChunkSize, ErrChunkTooLarge))
+	case l > maxInt:
+		return fr.corrupted(fmt.Errorf("chunk length %d out of range", l))
+	}
+	return nil
+}
+
+// readFramed reads the body along with its framing, for raw mode.
+func (fr *FileReader) readFramed(dst []byte) (int, error) {
+	for len(fr.frame) == 0 && fr.chunkRem == 0 {
+		switch {
+		case fr.done:
+			return 0, io.EOF
+		case fr.sumPending:
+			sum, err := fr.readNum(math.MaxUint32)
+			if err != nil {
+				return 0, err
+			}
+			if uint32(sum) != fr.crc {
+				return 0, fr.corrupted(ErrChecksum)
+			}
+			fr.crc = 0
+			fr.sumPending = false
+			fr.frame = appendNum(fr.num[:0], sum, fr.reader.varint)
+		default:
+			l, err := fr.readNum(holeChunk)
+			if err != nil {
+				return 0, err
+			}
+			fr.frame = appendNum(fr.num[:0], l, fr.reader.varint)
+			switch {
+			case l == 0:
+				fr.done = true
+				fr.reader.ready = true
+			case l == holeChunk:
+				n, err := fr.readHole()
+				if err != nil {
+					return 0, err
+				}
+				fr.frame = appendNum(fr.frame, n, fr.reader.varint)
+			default:
+				err = fr.checkChunkLength(l)
+				if err != nil {
+					return 0, err
+				}
+				fr.chunkRem = int(l)
+				fr.sumPending = fr.reader.checksums
+			}
+		}
+	}
+
+	if len(fr.frame) > 0 {
+		n := copy(dst, fr.frame)
+		fr.frame = fr.frame[n:]
+		return n, nil
+	}
+
+	if len(dst) > fr.chunkRem {
+		dst = dst[:fr.chunkRem]
+	}
+	n, err := fr.reader.stream.Read(dst)
+	fr.chunkRem -= n
+	if fr.reader.checksums {
+		fr.crc = crc32.Update(fr.crc, crc32.IEEETable, dst[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// readNum reads a number no greater than max in the framing of the stream.
+// Malformed numbers fail with ErrMalformedChunk, and mark the file as corrupt.
+func (fr *FileReader) readNum(max uint64) (uint64, error) {
+	if fr.reader.varint {
+		v, err := binary.ReadUvarint(fr.reader.stream)
+		switch {
+		case err == io.EOF:
+			return 0, io.ErrUnexpectedEOF
+		case err == io.ErrUnexpectedEOF:
+			return 0, fr.corrupted(err)
+		case err != nil:
+			return 0, fr.corrupted(fmt.Errorf("%w: %v", ErrMalformedChunk, err))
+		case v > max:
+			return 0, fr.corrupted(fmt.Errorf("%w: number %d out of range", ErrMalformedChunk, v))
+		}
+		return v, nil
+	}
+
+	dat, err := fr.reader.stream.ReadSlice('\x00')
+	switch err {
+	case nil:
+	case io.EOF:
+		return 0, io.ErrUnexpectedEOF
+	case bufio.ErrBufferFull:
+		return 0, fr.corrupted(fmt.Errorf("%w: number too long", ErrMalformedChunk))
+	default:
+		return 0, err
+	}
+	dat = dat[:len(dat)-1]
+	switch {
+	case len(dat) == 0:
+		return 0, fr.corrupted(fmt.Errorf("%w: missing number", ErrMalformedChunk))
+	case dat[0] == '-':
+		return 0, fr.corrupted(fmt.Errorf("%w: negative number %q", ErrMalformedChunk, dat))
+	}
+
+	var v uint64
+	for _, c := range dat {
+		if c < '0' || c > '9' {
+			return 0, fr.corrupted(fmt.Errorf("%w: invalid number %q", ErrMalformedChunk, dat))
+		}
+		// check the range before multiplying, which could otherwise wrap around
+		d := uint64(c - '0')
+		if v > (max-d)/10 {
+			return 0, fr.corrupted(fmt.Errorf("%w: number %q out of range", ErrMalformedChunk, dat))
+		}
+		v = 10*v + d
+	}
+
+	return v, nil
+}
+
+// corrupted marks the file as corrupt, so that the reader may skip over it.
+func (fr *FileReader) corrupted(err error) error {
+	if fr.reader.opts.SkipCorruptFiles {
+		fr.reader.corrupt = &corruptFile{
+			path: fr.hdr.Path,
+			err:  err,
+		}
+	}
+	return err
+}
+
+// countingReader is an io.Reader which counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(dat []byte) (int, error) {
+	n, err := cr.r.Read(dat)
+	cr.n += int64(n)
 	return n, err
 }
@@ -0,0 +1,1442 @@
+package filestream_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestSkipCorruptFiles(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		Path, Data string
+	}{
+		{"first.txt", "the first file"},
+		{"second.txt", "the second file"},
+		{"third.txt", "the third file"},
+	}
+	for _, f := range files {
+		fw, err := w.File(f.Path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(f.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the body of the second file
+	dat := buf.Bytes()
+	i := bytes.Index(dat, []byte("second file"))
+	if i < 0 {
+		t.Fatal("body of second file not found in stream")
+	}
+	dat[i] = 'S'
+
+	var skipped []string
+	r, err := filestream.NewReaderWithOptions(bytes.NewReader(dat), filestream.ReaderOptions{
+		SkipCorruptFiles: true,
+		OnCorruptFile: func(path string, err error) {
+			if !errors.Is(err, filestream.ErrChecksum) {
+				t.Errorf("expected checksum error but got %v", err)
+			}
+			skipped = append(skipped, path)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered := map[string]string{}
+	for r.Next() {
+		f := r.File()
+		dat, err := ioutil.ReadAll(f)
+		if err != nil {
+			continue
+		}
+		recovered[f.Path()] = string(dat)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("failed to recover: %s", err)
+	}
+
+	expect := map[string]string{
+		"first.txt": "the first file",
+		"third.txt": "the third file",
+	}
+	if diff := cmp.Diff(expect, recovered); diff != "" {
+		t.Errorf("unexpected recovered files: (-expect +got): %s", diff)
+	}
+	if diff := cmp.Diff([]string{"second.txt"}, skipped); diff != "" {
+		t.Errorf("unexpected skipped files: (-expect +got): %s", diff)
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{PerFileCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("hello.txt", filestream.FileOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.Write([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	// read raw body
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	raw, err := ioutil.ReadAll(r.File().RawBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("raw body is not gzip compressed: %s", err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello world" {
+		t.Errorf("expected raw body to decompress to %q but got %q", "hello world", string(body))
+	}
+	if r.Next() {
+		t.Error("unexpected extra file")
+	}
+	if err = r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read decompressed body
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	body, err = ioutil.ReadAll(r.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello world" {
+		t.Errorf("expected %q but got %q", "hello world", string(body))
+	}
+}
+
+func TestSkip(t *testing.T) {
+	for _, sopts := range []filestream.StreamOptions{{}, {Checksums: true}} {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, sopts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			fw, err := w.File(name, filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				_, err = fw.Write([]byte(name))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = fw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read []string
+		for r.Next() {
+			f := r.File()
+			if f.Path() == "b.txt" {
+				// skip part way through the file
+				_, err = f.Read(make([]byte, 2))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = f.Skip()
+				if err != nil {
+					t.Fatalf("failed to skip: %s", err)
+				}
+				continue
+			}
+			dat, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read = append(read, string(dat))
+		}
+		if err = r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"a.txta.txta.txt", "c.txtc.txtc.txt"}, read); diff != "" {
+			t.Errorf("unexpected files: (-expect +got): %s", diff)
+		}
+	}
+}
+
+func TestFileOffsets(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"dir/a.txt", "dir/b.txt"} {
+		fw, err := w.File(name, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("contents of " + name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := bytes.NewReader(buf.Bytes())
+
+	// build an index by scanning the stream
+	r, err := filestream.NewReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := map[string]int64{}
+	for r.Next() {
+		f := r.File()
+		index[f.Path()] = f.Offset()
+		err = f.Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3 {
+		t.Fatalf("expected 3 files but got %d", len(index))
+	}
+
+	// seek directly to each file
+	for path, offset := range index {
+		_, err = src.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jd, err := bufio.NewReader(src).ReadString('\x00')
+		if err != nil {
+			t.Fatalf("failed to read header of %q: %s", path, err)
+		}
+		var hdr struct {
+			Path string `json:"path"`
+		}
+		err = json.Unmarshal([]byte(jd[:len(jd)-1]), &hdr)
+		if err != nil {
+			t.Fatalf("failed to parse header of %q: %s", path, err)
+		}
+		if hdr.Path != path {
+			t.Errorf("expected header of %q at offset %d but found %q", path, offset, hdr.Path)
+		}
+	}
+}
+
+func TestFileNotConsumed(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, err := w.File(name, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	if r.Next() {
+		t.Fatal("expected Next to fail before finishing previous file")
+	}
+	if !errors.Is(r.Err(), filestream.ErrFileNotConsumed) {
+		t.Errorf("expected ErrFileNotConsumed but got %v", r.Err())
+	}
+}
+
+func TestRawReader(t *testing.T) {
+	for _, varint := range []bool{false, true} {
+		opts := filestream.StreamOptions{
+			Checksums:          true,
+			PerFileCompression: true,
+			VarintFraming:      varint,
+		}
+
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Directory("dir", filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, compression := range []string{"", "gzip"} {
+			fw, err := w.File("dir/"+compression+".txt", filestream.FileOptions{Compression: compression})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				_, err = fw.Write([]byte("hello world"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = fw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Hardlink("link.txt", "dir/gzip.txt", filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat := buf.Bytes()
+
+		// relay the stream through a raw reader
+		r, err := filestream.NewRawReader(bytes.NewReader(dat), filestream.ReaderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		w, err = filestream.NewWriter(&out, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			err = w.CopyRaw(r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out.Bytes(), dat) {
+			t.Errorf("relayed stream does not match (varint=%t):\n%q\n%q", varint, out.Bytes(), dat)
+		}
+	}
+}
+
+func TestCopyRawFraming(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewRawReader(&buf, filestream.ReaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	w, err = filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.CopyRaw(r.File()) == nil {
+		t.Error("copied file between streams with different framing")
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	for _, compression := range []string{"", "gzip", "lz4"} {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Directory("dir", filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the lz4 writer ends a frame on each flush
+		err = w.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Directory("dir2", filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("trailing data")
+		dat := buf.Bytes()
+
+		// trailing data is rejected by default
+		r, err := filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+		}
+		if r.Err() == nil {
+			t.Errorf("trailing data accepted by default (compression=%q)", compression)
+		}
+
+		r, err = filestream.NewReaderWithOptions(bytes.NewReader(dat), filestream.ReaderOptions{AllowTrailingData: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+		}
+		if err := r.Err(); err != nil {
+			t.Fatalf("failed to read stream with trailing data (compression=%q): %s", compression, err)
+		}
+		rem, err := ioutil.ReadAll(r.Remaining())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rem) != "trailing data" {
+			t.Errorf("expected remaining data %q but got %q (compression=%q)", "trailing data", string(rem), compression)
+		}
+	}
+}
+
+func TestStreamTrailer(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		Name string
+		Opts filestream.StreamOptions
+	}{
+		{"Gzip", filestream.StreamOptions{Compression: "gzip"}},
+		{"Encrypted", filestream.StreamOptions{Encryption: &filestream.Encryption{Key: key}}},
+		{"EncryptedGzip", filestream.StreamOptions{Compression: "gzip", Encryption: &filestream.Encryption{Key: key}}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, tc.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("hello.txt", []byte("hello"), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("plaintext trailer")
+
+			r, err := filestream.NewReaderWithOptions(bytes.NewReader(buf.Bytes()), filestream.ReaderOptions{
+				Encryption:        tc.Opts.Encryption,
+				AllowTrailingData: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{}
+			for r.Next() {
+				dat, err := ioutil.ReadAll(r.File())
+				if err != nil {
+					t.Fatal(err)
+				}
+				files[r.File().Path()] = string(dat)
+			}
+			if err := r.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(map[string]string{"hello.txt": "hello"}, files); diff != "" {
+				t.Errorf("unexpected files (-want +got):\n%s", diff)
+			}
+			trailer, err := ioutil.ReadAll(r.Remaining())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(trailer) != "plaintext trailer" {
+				t.Errorf("expected trailer %q but got %q", "plaintext trailer", trailer)
+			}
+
+			// the trailer is rejected without AllowTrailingData
+			r, err = filestream.NewReaderWithOptions(bytes.NewReader(buf.Bytes()), filestream.ReaderOptions{Encryption: tc.Opts.Encryption})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for r.Next() {
+			}
+			if r.Err() == nil {
+				t.Error("trailing data accepted by default")
+			}
+		})
+	}
+}
+
+func TestNextStream(t *testing.T) {
+	var buf bytes.Buffer
+	streams := [][]string{
+		{"first.txt", "second.txt"},
+		{"third.txt"},
+	}
+	for _, files := range streams {
+		w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: "gzip"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range files {
+			fw, err := w.File(path, filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fw.Write([]byte(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := filestream.NewReaderWithOptions(&buf, filestream.ReaderOptions{AllowTrailingData: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for {
+		var files []string
+		for r.Next() {
+			dat, err := ioutil.ReadAll(r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(dat) != r.File().Path() {
+				t.Errorf("expected %q but got %q", r.File().Path(), string(dat))
+			}
+			files = append(files, r.File().Path())
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, files)
+
+		more, err := r.NextStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !more {
+			break
+		}
+	}
+	if diff := cmp.Diff(streams, got); diff != "" {
+		t.Errorf("unexpected streams (-want +got):\n%s", diff)
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	tests := []struct {
+		Opts    filestream.StreamOptions
+		Version int
+	}{
+		{filestream.StreamOptions{}, 0},
+		{filestream.StreamOptions{Compression: "gzip"}, 0},
+		{filestream.StreamOptions{Compression: "lz4", Checksums: true}, 1},
+		{filestream.StreamOptions{VarintFraming: true}, 3},
+		{filestream.StreamOptions{Metadata: map[string]string{
+			"tool":     "filestream v1.2.3",
+			"hostname": "build-01",
+			"created":  "2019-06-01T12:00:00Z",
+		}}, 0},
+		{filestream.StreamOptions{Compression: "gzip", Metadata: map[string]string{"tool": "test"}}, 0},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, tc.Opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Version() != tc.Version {
+			t.Errorf("expected version %d but got %d", tc.Version, r.Version())
+		}
+		if r.Compression() != tc.Opts.Compression {
+			t.Errorf("expected compression %q but got %q", tc.Opts.Compression, r.Compression())
+		}
+		if diff := cmp.Diff(tc.Opts.Metadata, r.Metadata()); diff != "" {
+			t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestOnHeader(t *testing.T) {
+	dat, err := filestream.EncodeToBytes(map[string][]byte{
+		"hello.txt": []byte("hello world"),
+	}, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headers [][]byte
+	r, err := filestream.NewReaderWithOptions(bytes.NewReader(dat), filestream.ReaderOptions{
+		OnHeader: func(raw []byte) {
+			headers = append(headers, raw)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		_, err = ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// each header must be a copy of the exact bytes in the stream
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 headers but got %d", len(headers))
+	}
+	if !bytes.HasPrefix(dat, headers[0]) {
+		t.Errorf("stream header %q does not match the stream", headers[0])
+	}
+	for _, hdr := range headers[1:] {
+		if !bytes.Contains(dat, hdr) || !bytes.HasPrefix(hdr, []byte(`{"path":`)) {
+			t.Errorf("file header %q does not match the stream", hdr)
+		}
+		if hdr[len(hdr)-1] != 0 {
+			t.Errorf("file header %q is not null-terminated", hdr)
+		}
+	}
+	if string(headers[2]) != "{\"path\":\"\\u0000\"}\n\x00" {
+		t.Errorf("unexpected terminating header %q", headers[2])
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	// send a stream without a terminator, and then stall
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("file.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetDeadline(time.Now()); !errors.Is(err, filestream.ErrDeadlineUnsupported) {
+		t.Errorf("expected ErrDeadlineUnsupported but got %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(buf.Bytes())
+
+	r, err = filestream.NewReader(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("failed to read file: %v", r.Err())
+	}
+	_, err = io.Copy(ioutil.Discard, r.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Next() {
+		t.Fatal("read a file from a stalled stream")
+	}
+	var nerr net.Error
+	if !errors.As(r.Err(), &nerr) || !nerr.Timeout() {
+		t.Errorf("expected a timeout but got %v", r.Err())
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/file.txt", []byte("hello"), filestream.FileOptions{Permissions: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("failed to read directory: %v", r.Err())
+	}
+
+	// peeking is repeatable, and does not consume the entry
+	for i := 0; i < 2; i++ {
+		fh, err := r.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fh.Path() != "dir/file.txt" || fh.Opts().Permissions != 0600 {
+			t.Errorf("peeked unexpected entry %q with mode %v", fh.Path(), fh.Opts().Permissions)
+		}
+	}
+	if !r.Next() {
+		t.Fatalf("failed to read file: %v", r.Err())
+	}
+	if r.File().Path() != "dir/file.txt" {
+		t.Errorf("expected dir/file.txt but got %q", r.File().Path())
+	}
+	if _, err := r.Peek(); err != filestream.ErrFileNotConsumed {
+		t.Errorf("expected ErrFileNotConsumed but got %v", err)
+	}
+	data, err := ioutil.ReadAll(r.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("expected %q but got %q", "hello", data)
+	}
+
+	if _, err := r.Peek(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream but got %v", err)
+	}
+	if r.Next() {
+		t.Errorf("unexpected file %q", r.File().Path())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	src := writeTree(t, map[string]string{
+		"text.txt":   strings.Repeat("0123456789", 10000),
+		"sparse.img": "start" + strings.Repeat("\x00", 100000) + "end",
+		"empty.txt":  "",
+	})
+	defer os.RemoveAll(src)
+
+	for _, opts := range []filestream.StreamOptions{
+		{},
+		{Checksums: true, Sparse: true},
+		{VarintFraming: true, Checksums: true, Sparse: true},
+	} {
+		dat := encodeTree(t, src, opts, filestream.EncodeOptions{DetectSparse: opts.Sparse})
+
+		// io.Copy uses WriteTo, which must match reading through Read
+		read := map[string]string{}
+		r, err := filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			data, err := ioutil.ReadAll(struct{ io.Reader }{r.File()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read[r.File().Path()] = string(data)
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		readStats := r.Stats()
+
+		copied := map[string]string{}
+		r, err = filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			var buf bytes.Buffer
+			n, err := io.Copy(&buf, r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("WriteTo reported %d bytes but wrote %d", n, buf.Len())
+			}
+			copied[r.File().Path()] = buf.String()
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(read, copied); diff != "" {
+			t.Errorf("WriteTo does not match Read with %+v (-read +copied):\n%s", opts, diff)
+		}
+		if diff := cmp.Diff(readStats, r.Stats()); diff != "" {
+			t.Errorf("WriteTo stats do not match Read with %+v (-read +copied):\n%s", opts, diff)
+		}
+	}
+
+	// checksums are still verified
+	dat := encodeTree(t, src, filestream.StreamOptions{Checksums: true}, filestream.EncodeOptions{})
+	i := bytes.Index(dat, []byte("0123456789"))
+	if i < 0 {
+		t.Fatal("body not found in stream")
+	}
+	dat[i] = 'X'
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		_, err = io.Copy(ioutil.Discard, r.File())
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, filestream.ErrChecksum) {
+		t.Errorf("expected checksum error but got %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "a/b"} {
+		err = w.Directory(dir, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WriteFile(dir+"/file.txt", []byte("in "+dir), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Hardlink("a/link.txt", "a/file.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("c", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	// a directory pass does not need to read any file bodies
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Filter((*filestream.FileHeader).IsDir)
+	var dirs []string
+	for r.Next() {
+		dirs = append(dirs, r.File().Path())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a", "a/b", "c"}, dirs); diff != "" {
+		t.Errorf("unexpected directories (-want +got):\n%s", diff)
+	}
+
+	// a file pass, which also peeks past filtered entries
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Filter(func(fh *filestream.FileHeader) bool {
+		return !fh.IsDir() && fh.HardlinkTo() == ""
+	})
+	fh, err := r.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.Path() != "a/file.txt" {
+		t.Errorf("peeked %q instead of the first file", fh.Path())
+	}
+	files := map[string]string{}
+	for r.Next() {
+		data, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[r.File().Path()] = string(data)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"a/file.txt": "in a", "a/b/file.txt": "in a/b"}, files); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompactTerminator(t *testing.T) {
+	encode := func(opts filestream.StreamOptions) []byte {
+		t.Helper()
+
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WriteFile("hello.txt", []byte("hello"), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decode := func(dat []byte) ([]string, error) {
+		r, err := filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for r.Next() {
+			paths = append(paths, r.File().Path())
+			err = r.File().Skip()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return paths, r.Err()
+	}
+
+	old := encode(filestream.StreamOptions{})
+	if !bytes.HasSuffix(old, []byte("{\"path\":\"\\u0000\"}\n\x00")) {
+		t.Errorf("expected a JSON terminator by default but got %q", old)
+	}
+	compact := encode(filestream.StreamOptions{CompactTerminator: true, VarintFraming: true})
+	if !bytes.HasSuffix(compact, []byte("\x00\x00")) || bytes.Contains(compact, []byte("\\u0000")) {
+		t.Errorf("expected a compact terminator but got %q", compact)
+	}
+
+	// both forms must decode
+	for name, dat := range map[string][]byte{"JSON": old, "Compact": compact} {
+		paths, err := decode(dat)
+		if err != nil {
+			t.Errorf("failed to decode %s terminator: %v", name, err)
+		} else if diff := cmp.Diff([]string{"hello.txt"}, paths); diff != "" {
+			t.Errorf("unexpected paths with %s terminator (-want +got):\n%s", name, diff)
+		}
+	}
+
+	// an empty header is not a terminator in streams prior to v7
+	_, err := decode(append(old[:bytes.IndexByte(old, 0)+1], 0))
+	if err == nil {
+		t.Error("accepted compact terminator in a stream prior to v7")
+	}
+
+	// a stream with a compact terminator can be appended to
+	f, err := ioutil.TempFile("", "filestream-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := filestream.NewAppendWriter(f, filestream.StreamOptions{CompactTerminator: true, VarintFraming: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("world.txt", []byte("world"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := decode(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"hello.txt", "world.txt"}, paths); diff != "" {
+		t.Errorf("unexpected paths after append (-want +got):\n%s", diff)
+	}
+
+	// an empty stream with a compact terminator is shorter than a JSON terminator
+	opts := filestream.StreamOptions{CompactTerminator: true}
+	var empty bytes.Buffer
+	w, err = filestream.NewWriter(&empty, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(empty.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = filestream.NewAppendWriter(f, opts)
+	if err != nil {
+		t.Fatalf("failed to append to empty stream: %v", err)
+	}
+	err = w.WriteFile("hello.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err = ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err = decode(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"hello.txt"}, paths); diff != "" {
+		t.Errorf("unexpected paths after appending to empty stream (-want +got):\n%s", diff)
+	}
+}
+
+func TestMaxChunkSize(t *testing.T) {
+	t.Run("Oversized", func(t *testing.T) {
+		// a single file declaring an absurd chunk length
+		src := "{\"version\":0}\n\x00{\"path\":\"evil.txt\"}\n\x009999999999999\x00"
+		r, err := filestream.NewReader(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Next() {
+			t.Fatalf("missing file: %v", r.Err())
+		}
+		_, err = ioutil.ReadAll(r.File())
+		if !errors.Is(err, filestream.ErrChunkTooLarge) {
+			t.Errorf("expected ErrChunkTooLarge but got %v", err)
+		}
+	})
+	t.Run("Limit", func(t *testing.T) {
+		dat, err := filestream.EncodeToBytes(map[string][]byte{"file.txt": bytes.Repeat([]byte("x"), 1000)}, filestream.StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReaderWithOptions(bytes.NewReader(dat), filestream.ReaderOptions{MaxChunkSize: 999})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Next() {
+			t.Fatalf("missing file: %v", r.Err())
+		}
+		_, err = ioutil.ReadAll(r.File())
+		if !errors.Is(err, filestream.ErrChunkTooLarge) {
+			t.Errorf("expected ErrChunkTooLarge from reader but got %v", err)
+		}
+
+		r, err = filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{DryRun: true, MaxChunkSize: 999})
+		if !errors.Is(err, filestream.ErrChunkTooLarge) {
+			t.Errorf("expected ErrChunkTooLarge from DecodeFiles but got %v", err)
+		}
+
+		r, err = filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{DryRun: true, MaxChunkSize: 1000})
+		if err != nil {
+			t.Errorf("chunk at the limit was rejected: %v", err)
+		}
+	})
+}
+
+func TestMalformedChunk(t *testing.T) {
+	// 18446744073709551620 wraps around to 4 if the range is not checked before each digit
+	for _, length := range []string{"-1", "-5", "abc", "12abc", "", "18446744073709551620", "99999999999999999999999"} {
+		length := length
+		t.Run(length, func(t *testing.T) {
+			src := "{\"version\":0}\n\x00{\"path\":\"file.txt\"}\n\x00" + length + "\x00data"
+			r, err := filestream.NewReader(strings.NewReader(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !r.Next() {
+				t.Fatalf("missing file: %v", r.Err())
+			}
+			_, err = ioutil.ReadAll(r.File())
+			if !errors.Is(err, filestream.ErrMalformedChunk) {
+				t.Errorf("expected ErrMalformedChunk but got %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressedBodyExcess(t *testing.T) {
+	// a gzip body followed by uncompressed data within the same file
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	_, err := zw.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.WriteString("trailer")
+
+	src := "{\"version\":2}\n\x00{\"path\":\"file.txt\",\"compression\":\"gzip\"}\n\x00" + strconv.Itoa(body.Len()) + "\x00" + body.String() + "0\x00{\"path\":\"\\u0000\"}\n\x00"
+	r, err := filestream.NewReader(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	dat, err := ioutil.ReadAll(r.File())
+	if err == nil || !strings.Contains(err.Error(), "excess data") {
+		t.Errorf("expected an excess data error but got %v", err)
+	}
+	if string(dat) != "hello" {
+		t.Errorf("expected %q but got %q", "hello", dat)
+	}
+}
+
+func TestGzipMultistream(t *testing.T) {
+	dat, err := filestream.EncodeToBytes(map[string][]byte{"file.txt": bytes.Repeat([]byte("data"), 1000)}, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := bytes.IndexByte(dat, 0) + 1
+	body := dat[hdr:]
+
+	// gzip compresses the given pieces as separate members
+	gzipMembers := func(pieces ...[]byte) []byte {
+		buf := bytes.NewBufferString("{\"version\":0,\"compression\":\"gzip\"}\n\x00")
+		for _, p := range pieces {
+			zw := gzip.NewWriter(buf)
+			_, err := zw.Write(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = zw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("Multistream", func(t *testing.T) {
+		// the stream is split across two members
+		split := gzipMembers(body[:len(body)/2], body[len(body)/2:])
+		got, err := filestream.DecodeToMap(split)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got["file.txt"]) != 4000 {
+			t.Errorf("expected 4000 bytes but got %d", len(got["file.txt"]))
+		}
+
+		// reading only the first member truncates the stream
+		r, err := filestream.NewReaderWithOptions(bytes.NewReader(split), filestream.ReaderOptions{GzipSingleMember: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			_, err = io.Copy(ioutil.Discard, r.File())
+			if err != nil {
+				break
+			}
+		}
+		if err == nil && r.Err() == nil {
+			t.Error("read a split stream from a single member")
+		}
+	})
+	t.Run("SingleMember", func(t *testing.T) {
+		// the stream is followed by an unrelated member
+		joined := gzipMembers(body, []byte("unrelated"))
+		_, err := filestream.DecodeToMap(joined)
+		if err == nil {
+			t.Error("accepted an unrelated member as part of the stream")
+		}
+
+		r, err := filestream.NewReaderWithOptions(bytes.NewReader(joined), filestream.ReaderOptions{GzipSingleMember: true, AllowTrailingData: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			_, err = io.Copy(ioutil.Discard, r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(r.Remaining())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rem, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rem) != "unrelated" {
+			t.Errorf("expected %q after the stream but got %q", "unrelated", rem)
+		}
+
+		// without AllowTrailingData, the following member is rejected
+		r, err = filestream.NewReaderWithOptions(bytes.NewReader(joined), filestream.ReaderOptions{GzipSingleMember: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			_, err = io.Copy(ioutil.Discard, r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if r.Err() == nil {
+			t.Error("accepted a following member without AllowTrailingData")
+		}
+	})
+}
+
+func TestNewReaderFromBytes(t *testing.T) {
+	for _, compression := range []string{"", "gzip", "lz4"} {
+		compression := compression
+		t.Run("Compression="+compression, func(t *testing.T) {
+			files := map[string]string{
+				"small.txt": "small",
+				"big.txt":   strings.Repeat("big file body\n", 10000),
+			}
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: compression, Checksums: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, path := range []string{"small.txt", "big.txt"} {
+				err = w.WriteFile(path, []byte(files[path]), filestream.FileOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := filestream.NewReaderFromBytes(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			for r.Next() {
+				dat, err := ioutil.ReadAll(r.File())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(dat) != files[r.File().Path()] {
+					t.Errorf("body of %q was corrupted", r.File().Path())
+				}
+				n++
+			}
+			if err := r.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if n != len(files) {
+				t.Errorf("expected %d files but got %d", len(files), n)
+			}
+
+			// the stats should match those of a reader over the same data
+			ref, err := filestream.NewReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ref.Next() {
+				_, err = io.Copy(ioutil.Discard, ref.File())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ref.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(ref.Stats(), r.Stats()); diff != "" {
+				t.Errorf("unexpected stats (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		for _, dat := range []string{"", `{"version":1}`} {
+			_, err := filestream.NewReaderFromBytes([]byte(dat))
+			if err != io.EOF {
+				t.Errorf("expected EOF for %q but got %v", dat, err)
+			}
+		}
+	})
+}
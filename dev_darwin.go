@@ -0,0 +1,23 @@
+// +build darwin
+
+package filestream
+
+import (
+	"os"
+	"syscall"
+)
+
+// getDevice gets the major and minor numbers of a device file.
+func getDevice(info os.FileInfo) (major, minor uint32, ok bool) {
+	dev := uint32(info.Sys().(*syscall.Stat_t).Rdev)
+	return dev >> 24, dev & 0xffffff, true
+}
+
+// mknod creates a FIFO or device file.
+func mknod(path string, mode os.FileMode, major, minor uint32) error {
+	err := syscall.Mknod(path, unixMode(mode), int(major<<24|minor&0xffffff))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// +build linux
+
+package filestream
+
+import (
+	"os"
+	"syscall"
+)
+
+// getDevice gets the major and minor numbers of a device file.
+func getDevice(info os.FileInfo) (major, minor uint32, ok bool) {
+	dev := uint64(info.Sys().(*syscall.Stat_t).Rdev)
+	major = uint32((dev>>8)&0xfff) | uint32(dev>>32)&^0xfff
+	minor = uint32(dev&0xff) | uint32(dev>>12)&^0xff
+	return major, minor, true
+}
+
+// mknod creates a FIFO or device file.
+func mknod(path string, mode os.FileMode, major, minor uint32) error {
+	dev := uint64(minor&0xff) | uint64(major&0xfff)<<8 | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+	err := syscall.Mknod(path, unixMode(mode), int(dev))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
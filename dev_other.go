@@ -0,0 +1,18 @@
+// +build !linux,!darwin
+
+package filestream
+
+import (
+	"errors"
+	"os"
+)
+
+// getDevice is not supported on this platform.
+func getDevice(info os.FileInfo) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
+
+// mknod is not supported on this platform.
+func mknod(path string, mode os.FileMode, major, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: path, Err: errors.New("special files are not supported on this platform")}
+}
@@ -0,0 +1,125 @@
+// +build linux darwin
+
+package filestream_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestFIFO(t *testing.T) {
+	src, err := ioutil.TempDir("", "filestream-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	err = syscall.Mkfifo(filepath.Join(src, "fifo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	dat := encodeTree(t, src, filestream.StreamOptions{}, filestream.EncodeOptions{IncludePermissions: true})
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:                dst,
+		PreservePermissions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dst, "fifo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("expected FIFO but got %s", info.Mode())
+	}
+}
+
+func TestDevices(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Special("null", 1, 3, filestream.FileOptions{Permissions: os.ModeDevice | os.ModeCharDevice | 0666})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Special("sock", 0, 0, filestream.FileOptions{Permissions: os.ModeSocket | 0666}) == nil {
+		t.Error("socket accepted")
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing device: %v", r.Err())
+	}
+	if major, minor := r.File().Device(); major != 1 || minor != 3 {
+		t.Errorf("expected device 1:3 but got %d:%d", major, minor)
+	}
+
+	// devices are skipped by default
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "null")); !os.IsNotExist(err) {
+		t.Errorf("device created without CreateDevices: %v", err)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("creating devices requires root")
+	}
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:                dst,
+		PreservePermissions: true,
+		CreateDevices:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("expected character device but got %s", info.Mode())
+	}
+}
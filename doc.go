@@ -1,3 +1,5 @@
 // Package filestream implements a mechanism for streaming bundles of files over a single data stream.
 // The data uses a chunked encoding, so data can be written without knowing the length of the data ahead of time.
+//
+// Errors wrap their causes with the error wrapping introduced in Go 1.13 (the minimum supported version), so they can be inspected with errors.Is and errors.As.
 package filestream
@@ -2,34 +2,164 @@ package filestream
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // StreamOptions are configuration options for a stream.
 type StreamOptions struct {
 	// Compression is the compression algorithm to use in transit.
-	// This package supports "gzip" and "lz4".
+	// This package supports "gzip", "lz4", and "brotli".
 	// Defaults to no compresion.
 	Compression string
 
 	// CompressionLevel is the level of compresion to use.
+	// For gzip, this is -2 (Huffman only) to 9 (best compression).
+	// For lz4, a level from 1 to 65536 selects high compression mode, with the level as the search depth.
+	// For brotli, this is the quality from 1 (fastest) to 11 (best compression), and the default quality is 6.
 	// Uses a sane default if omitted.
 	CompressionLevel int
+
+	// CompressionConcurrency is the maximum number of goroutines used to compress the stream.
+	// If greater than 1, gzip compression splits the stream into blocks which are compressed in parallel.
+	// The output is still a single standard gzip stream, although slightly larger.
+	// This does not apply to lz4 or per-file compression.
+	CompressionConcurrency int
+
+	// LZ4 are options for the lz4 frame format, which are used for lz4 compression of the stream and of individual files.
+	// By default, frames have a content checksum but no block checksums, and use 4 MiB blocks.
+	// Optional.
+	LZ4 *LZ4Options
+
+	// Checksums is whether to follow each chunk of file data with a CRC-32 checksum.
+	// This allows readers to detect corruption of file data.
+	// Streams with checksums cannot be read by readers prior to format v1.
+	Checksums bool
+
+	// OnDestinationError is used by NewMultiWriter to handle the failure of a destination.
+	// It is called with the index of the failed destination and the error.
+	// If it returns true, the destination is dropped and the stream continues to the remaining destinations.
+	// Otherwise, or if it is nil, the stream is aborted.
+	OnDestinationError func(i int, err error) bool
+
+	// PerFileCompression is whether to allow compression of individual files with FileOptions.Compression.
+	// This is independent of the stream compression, although using both is rarely useful.
+	// Streams with per-file compression cannot be read by readers prior to format v2.
+	PerFileCompression bool
+
+	// Progress is an optional callback which is invoked after each chunk of a file is written.
+	// It is called with the path of the file and the number of bytes of the file which have been written so far.
+	// The callback is invoked after the writer has finished processing the chunk, so it may safely use the Writer.
+	Progress func(path string, bytesWritten int64)
+
+	// ProgressInterval is the minimum number of bytes of a file between calls to Progress.
+	// When it is set, Progress is also called once the file is complete if the final size has not yet been reported.
+	// Defaults to 0, which calls Progress after every chunk.
+	ProgressInterval int64
+
+	// Sparse is whether to allow holes in file bodies, which are encoded without their zero bytes.
+	// This is required by EncodeOptions.DetectSparse.
+	// Streams with sparse files cannot be read by readers prior to format v5.
+	Sparse bool
+
+	// FileDone is an optional callback which is invoked after a file has been completed.
+	// It is called with the path of the file and the total number of bytes written to the file.
+	// The callback is invoked after the file has been closed, so it may safely use the Writer.
+	FileDone func(path string, bytesWritten int64)
+
+	// VarintFraming is whether to encode chunk lengths and checksums as binary varints rather than decimal strings.
+	// This reduces the overhead of small chunks.
+	// Streams with varint framing cannot be read by readers prior to format v3.
+	VarintFraming bool
+
+	// Encryption is an optional configuration to encrypt the stream with AES-256-GCM.
+	// Data is compressed before it is encrypted.
+	// The stream header is not encrypted, although it does not contain any file information.
+	// Streams with encryption cannot be read by readers prior to format v4.
+	Encryption *Encryption
+
+	// StrictPaths is whether to reject paths which may be unsafe to decode.
+	// This rejects absolute paths, ".." components, backslashes, and control characters, in both paths and hard link targets.
+	// Paths must be slash-separated, although the separator of the platform is converted to "/" before the check.
+	// By default, only null characters are rejected.
+	StrictPaths bool
+
+	// AutoDirs is whether to emit a directory entry for each parent directory of an entry which has not already appeared in the stream.
+	// The implicit directories are written with default options immediately before the entry, from the outermost inward, so a parent always precedes its children.
+	// A directory which is written explicitly after it has been created implicitly appears in the stream twice.
+	// Paths are treated as slash-separated.
+	AutoDirs bool
+
+	// Metadata is application-specific information about the stream, such as the tool which produced it and when.
+	// It is stored in the stream header, which is not encrypted, and can be read with Reader.Metadata.
+	// It is not used by NewAppendWriter, which keeps the metadata of the existing stream.
+	// Optional.
+	Metadata map[string]string
+
+	// ChunkSize is the size of the chunks which file bodies are split into.
+	// If set, writes to a file are buffered and sent in chunks of exactly this size (except for the last chunk of the file), regardless of the size of each write.
+	// Larger chunks reduce framing overhead, at the cost of buffering up to ChunkSize bytes in memory.
+	// Flush sends a buffered partial chunk immediately.
+	// This does not apply to files created with FileN or WriteFile, which send the body as a single chunk.
+	// By default, each write is sent as a chunk.
+	ChunkSize int
+
+	// MinChunkSize is the minimum size of the chunks which file bodies are split into.
+	// If set, small writes to a file are buffered until at least this much data is available, and then sent together as one chunk.
+	// Writes of at least MinChunkSize bytes are sent as they are, and a smaller chunk may still be sent by Flush or at the end of the file.
+	// This avoids the framing overhead of many tiny chunks, such as when a file is written by an encoder.
+	// It has no effect if ChunkSize is set, as all chunks are then already ChunkSize bytes.
+	MinChunkSize int
+
+	// BufferSize is the size of the buffers used to write the stream, in bytes.
+	// Larger buffers send data in fewer, larger writes, which may improve throughput over high-latency links.
+	// It must be at least 512 bytes, and defaults to 4096 bytes.
+	// With compression or encryption, there are two buffers of this size: one before and one after compression.
+	BufferSize int
+
+	// Index is whether to write an index of the stream after the terminator, so that files can be opened directly with OpenIndexed.
+	// The index records the offset of each entry, and is only useful if the stream is stored somewhere seekable.
+	// Indexes are not supported for compressed or encrypted streams, since the offsets could not be sought to.
+	// Streams with indexes cannot be read by readers prior to format v6.
+	Index bool
+
+	// CompactTerminator is whether to end the stream with an empty header (a single null byte) rather than a JSON terminating header.
+	// Streams with compact terminators cannot be read by readers prior to format v7.
+	// When recovering from corruption with ReaderOptions.SkipCorruptFiles, a compact terminator cannot be found by scanning, so corruption in the last file is reported as an unexpected EOF.
+	CompactTerminator bool
+
+	// Manifest is an optional list of the files which will be written to the stream, which is sent before the first file.
+	// Readers can use it to find the total size of the stream before extracting, such as for progress bars, with Reader.Manifest.
+	// The manifest is not checked against the files which are actually written, so it should be created with BuildManifest or from the same data.
+	// It is stored as an entry with the reserved path ".filestream-manifest", which readers prior to manifest support decode as an ordinary file.
+	// A manifest cannot be added when appending to a stream.
+	Manifest *Manifest
 }
 
 // FileOptions are the set of options which can be applied to a file stream.
 type FileOptions struct {
 	// Permissions are the unix permission code of the file.
-	// If the permissions component is 000, this will be converted to sane defaults.
+	// If the permissions component is 000, this will be converted to sane defaults unless ExactPermissions is set.
 	// Optional.
 	Permissions os.FileMode
 
+	// ExactPermissions stores Permissions exactly as given, even if the permissions component is 000.
+	// Readers will then restore a mode of 000 instead of substituting defaults.
+	ExactPermissions bool
+
 	// User is the username of the owner.
 	// Optional.
 	User string
@@ -37,57 +167,314 @@ type FileOptions struct {
 	// Group is the groupname of the owning group.
 	// Optional.
 	Group string
+
+	// Compression is the compression algorithm to apply to the body of this file.
+	// This requires StreamOptions.PerFileCompression, and supports the same algorithms as stream compression.
+	// Defaults to no compression.
+	Compression string
+
+	// CompressionLevel is the level of compression to use for the body of this file.
+	// The range is the same as for StreamOptions.CompressionLevel.
+	// Uses a sane default if omitted.
+	CompressionLevel int
+
+	// Xattrs are the extended attributes of the file.
+	// Optional.
+	Xattrs map[string][]byte
+
+	// Extra is application-specific metadata, such as a content type or an upstream checksum.
+	// It is stored in the file header, and is not interpreted by this package.
+	// Optional.
+	Extra map[string]string
+
+	// ContentType is the MIME type of the file body, such as "image/png".
+	// Optional.
+	ContentType string
 }
 
 // Writer is an encoder for a filestream.
+// A Writer is not safe for concurrent use: overlapping calls from multiple goroutines fail with ErrConcurrentUse.
 type Writer struct {
-	curFile uint64
-	writing bool
-	w       bufio.Writer
-	closer  io.Closer
-	closed  bool
+	curFile   uint64
+	writing   bool
+	checksums bool
+	perFile   bool
+	varint    bool
+	sparse    bool
+	strict    bool
+	progress  func(string, int64)
+	fileDone  func(string, int64)
+	interval  int64
+	w         bufio.Writer
+	out       *bufio.Writer
+	closer    io.Closer
+	flushers  []flusher
+	cur       *fileWriter
+	closed    bool
+	dst       *countingWriter
+	stats     Stats
+
+	// dirs is the set of directories in the stream, if AutoDirs is enabled.
+	dirs map[string]bool
+
+	// chunkSize is the size of chunks to buffer file data into, or 0 to send each write as a chunk.
+	chunkSize int
+
+	// minChunkSize is the size below which writes are coalesced, or 0 to send each write as a chunk.
+	minChunkSize int
+
+	// index is the index of the stream so far, if the stream is indexed.
+	index   []indexEntry
+	indexed bool
+
+	// compactTerminator is whether to terminate the stream with an empty header.
+	compactTerminator bool
+
+	// lz4 are the options for lz4 compression of file bodies
+	lz4 *LZ4Options
+
+	// chunk is the buffered data of the current file which has not yet been sent as a chunk.
+	chunk []byte
+
+	// num is scratch space for formatting chunk lengths and checksums.
+	num [binary.MaxVarintLen64 + 1]byte
+
+	// busy is set while an operation is in progress, in order to detect concurrent use.
+	busy int32
+
+	// pending are the callbacks to run once the current operation completes.
+	pending []callback
+}
+
+// ErrInvalidBufferSize indicates that a buffer size is too small.
+var ErrInvalidBufferSize = errors.New("invalid buffer size")
+
+// minBufferSize is the smallest buffer size which may be configured.
+const minBufferSize = 512
+
+// defaultBufferSize is the buffer size used when none is configured.
+const defaultBufferSize = 4096
+
+// checkBufferSize checks that a configured buffer size is either unset or at least the minimum.
+func checkBufferSize(size int) error {
+	if size != 0 && size < minBufferSize {
+		return fmt.Errorf("%w: %d bytes (minimum: %d bytes)", ErrInvalidBufferSize, size, minBufferSize)
+	}
+	return nil
+}
+
+// bufferSize returns the buffer size to use for a configured size.
+func bufferSize(size int) int {
+	if size == 0 {
+		return defaultBufferSize
+	}
+	return size
 }
 
 // NewWriter creates a new file stream writer.
 func NewWriter(dst io.Writer, opts StreamOptions) (*Writer, error) {
+	w, hdr := newWriter(dst, opts)
+
+	// The stream is composed of the following layers, from the top down:
+	//	w.w: buffers framed file data
+	//	compressor (optional)
+	//	encrypter (optional)
+	//	w.out: buffers all output to dst
+	// The stream header is written directly into w.out, so it always precedes the body regardless of how the other layers buffer data.
+	// Without compression or encryption, w.w and w.out are the same buffer.
+	var body io.Writer
+	var closers closeChain
+	err := checkBufferSize(opts.BufferSize)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.LZ4.check()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Index && (opts.Encryption != nil || opts.Compression != "") {
+		return nil, errors.New("indexes are not supported for compressed or encrypted streams")
+	}
+	if opts.Encryption != nil || opts.Compression != "" {
+		w.out = bufio.NewWriterSize(w.dst, bufferSize(opts.BufferSize))
+		body = w.out
+	} else {
+		w.out = &w.w
+	}
+
+	// obtain encrypter
+	if opts.Encryption != nil {
+		ehdr, aead, err := newEncryption(opts.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Encryption = ehdr
+		hdr.require(encryptionVersion)
+		ew := newEncryptWriter(body, aead, ehdr.Nonce)
+		body = ew
+		closers = append(closers, ew)
+		w.flushers = append(w.flushers, ew)
+	}
+
 	// obtain compressor
-	var z io.WriteCloser
 	if opts.Compression != "" {
-		zr, err := compress(opts.Compression, opts.CompressionLevel, dst)
+		var z io.WriteCloser
+		var err error
+		if opts.Compression == "gzip" && opts.CompressionConcurrency > 1 {
+			z, err = newParallelGzipWriter(body, opts.CompressionLevel, opts.CompressionConcurrency)
+		} else {
+			z, err = compress(opts.Compression, opts.CompressionLevel, opts.LZ4, body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		body = z
+		closers = append(closeChain{z}, closers...)
+		if f, ok := z.(flusher); ok {
+			w.flushers = append([]flusher{f}, w.flushers...)
+		}
+	}
+	if closers != nil {
+		w.closer = closers
+	}
+
+	// write header
+	n, err := writeHeader(w.out, hdr)
+	w.stats.HeaderBytes += int64(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write stream header: %w", err)
+	}
+
+	// send file data through the compressor or encrypter
+	if body != nil {
+		w.w.Reset(body)
+	}
+
+	// write the manifest before any files
+	if opts.Manifest != nil {
+		err = w.writeManifest(opts.Manifest)
 		if err != nil {
 			return nil, err
 		}
-		z = zr
 	}
 
+	return w, nil
+}
+
+// newWriter sets up a writer with the given options, and prepares the stream header.
+// No compression or encryption is set up.
+func newWriter(dst io.Writer, opts StreamOptions) (*Writer, streamHeader) {
 	// set up writer
 	w := new(Writer)
-	w.w = *bufio.NewWriter(dst)
-	if opts.Compression != "" {
-		w.closer = z
+	w.dst = &countingWriter{w: dst}
+	dst = w.dst
+	w.w = *bufio.NewWriterSize(dst, bufferSize(opts.BufferSize))
+	w.progress, w.fileDone = opts.Progress, opts.FileDone
+	w.interval = opts.ProgressInterval
+	w.lz4 = opts.LZ4
+	w.strict = opts.StrictPaths
+	w.chunkSize, w.minChunkSize = opts.ChunkSize, opts.MinChunkSize
+	if opts.AutoDirs {
+		w.dirs = map[string]bool{}
 	}
 
-	// write header
-	err := json.NewEncoder(&w.w).Encode(streamHeader{
-		Version:     0,
+	// prepare header
+	hdr := streamHeader{
 		Compression: opts.Compression,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to write stream header: %s", err)
+		Metadata:    opts.Metadata,
+	}
+	if opts.Checksums {
+		hdr.Checksum = "crc32"
+		hdr.require(checksumVersion)
+		w.checksums = true
+	}
+	if opts.PerFileCompression {
+		hdr.require(perFileCompressionVersion)
+		w.perFile = true
+	}
+	if opts.VarintFraming {
+		hdr.Framing = "varint"
+		hdr.require(varintFramingVersion)
+		w.varint = true
+	}
+	if opts.Sparse {
+		hdr.Sparse = true
+		hdr.require(sparseVersion)
+		w.sparse = true
+	}
+	if opts.CompactTerminator {
+		hdr.require(compactTerminatorVersion)
+		w.compactTerminator = true
+	}
+	if opts.Index {
+		hdr.Index = true
+		hdr.require(indexVersion)
+		w.indexed = true
+	}
+	if opts.Manifest != nil {
+		hdr.Manifest = true
+	}
+
+	return w, hdr
+}
+
+// NewAppendWriter creates a file stream writer which appends files to an existing stream.
+// The existing stream is scanned and its terminator is overwritten, so the stream is left unterminated until the writer is closed.
+// Only uncompressed and unencrypted streams can be appended to, and the existing stream must use the same checksum and framing options.
+func NewAppendWriter(dst io.ReadWriteSeeker, opts StreamOptions) (*Writer, error) {
+	if opts.Compression != "" || opts.Encryption != nil {
+		return nil, errors.New("appending is only supported for uncompressed and unencrypted streams")
 	}
-	err = w.w.WriteByte('\x00')
+	err := checkBufferSize(opts.BufferSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write stream header: %s", err)
+		return nil, err
 	}
 
-	// set destination to compressor
-	if opts.Compression != "" {
-		err = w.w.Flush()
+	// scan the existing stream
+	_, err = dst.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read existing stream: %w", err)
+	}
+	w, hdr := newWriter(dst, opts)
+	switch {
+	case r.hdr.Compression != "" || r.hdr.Encryption != nil:
+		return nil, errors.New("cannot append to a compressed or encrypted stream")
+	case r.hdr.Checksum != hdr.Checksum:
+		return nil, errors.New("existing stream does not match checksum option")
+	case r.hdr.Framing != hdr.Framing:
+		return nil, errors.New("existing stream does not match framing option")
+	case hdr.Sparse && !r.hdr.Sparse:
+		return nil, errors.New("existing stream does not allow sparse files")
+	case hdr.Index || r.hdr.Index:
+		return nil, errors.New("appending to indexed streams is not supported")
+	case hdr.Manifest:
+		return nil, errors.New("a manifest cannot be added when appending to a stream")
+	case r.hdr.Version < hdr.Version:
+		return nil, fmt.Errorf("existing stream has format version %d, but the options require version %d", r.hdr.Version, hdr.Version)
+	}
+	for r.Next() {
+		if w.dirs != nil && r.File().Opts().Permissions.IsDir() {
+			w.dirs[path.Clean(r.File().Path())] = true
+		}
+		err = r.File().Skip()
 		if err != nil {
-			return nil, fmt.Errorf("failed to write stream header: %s", err)
+			return nil, fmt.Errorf("failed to read existing stream: %w", err)
 		}
-		w.w.Reset(z)
 	}
+	if err = r.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read existing stream: %w", err)
+	}
+
+	// seek back to the terminator
+	_, err = dst.Seek(r.end, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	w.out = &w.w
 
 	return w, nil
 }
@@ -95,34 +482,194 @@ func NewWriter(dst io.Writer, opts StreamOptions) (*Writer, error) {
 // File creates a new file stream at the given path.
 // The file must be closed in order to be committed to the stream.
 // Attempting to call File or Directory before closing a file may result in an error.
+// Paths may use the separator of the platform, which is converted to "/" in the stream.
 func (w *Writer) File(path string, opts FileOptions) (io.WriteCloser, error) {
+	err := w.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer w.release()
+
+	fw, err := w.openFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// openFile creates a new file stream at the given path.
+func (w *Writer) openFile(path string, opts FileOptions) (*fileWriter, error) {
+	hdr := opts.header(path)
+	hdr.Compression = opts.Compression
+	return w.compressedFile(hdr, opts.CompressionLevel)
+}
+
+// startEntry creates a new file stream with the given header, compressing the body if the header specifies a compression algorithm.
+// This is used by EncodeFiles, which prepares headers directly.
+func (w *Writer) startEntry(hdr fileHeader) (*fileWriter, error) {
+	err := w.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer w.release()
+
+	return w.compressedFile(hdr, 0)
+}
+
+// compressedFile creates a new file stream with the given header, and sets up the compressor for the body if the header specifies one.
+func (w *Writer) compressedFile(hdr fileHeader, level int) (*fileWriter, error) {
+	if hdr.Compression != "" && !w.perFile {
+		return nil, errors.New("per-file compression is not enabled for this stream")
+	}
+
+	fw, err := w.file(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Compression != "" {
+		z, err := compress(hdr.Compression, level, w.lz4, chunkWriter{fw})
+		if err != nil {
+			w.writing = false
+			return nil, err
+		}
+		fw.z = z
+	}
+
+	return fw, nil
+}
+
+// header creates a file header with the options.
+func (opts FileOptions) header(path string) fileHeader {
+	return fileHeader{
+		Path:        path,
+		Mode:        opts.Permissions,
+		ExactMode:   opts.ExactPermissions && opts.Permissions.Perm() == 0,
+		User:        opts.User,
+		Group:       opts.Group,
+		Xattrs:      opts.Xattrs,
+		Extra:       opts.Extra,
+		ContentType: opts.ContentType,
+	}
+}
+
+// ErrConcurrentUse indicates that a Writer was used by multiple goroutines at the same time.
+// A Writer is not safe for concurrent use, but overlapping operations are detected and rejected rather than corrupting the stream.
+// Use a Mux to write to a stream from multiple goroutines.
+var ErrConcurrentUse = errors.New("concurrent use of filestream writer")
+
+// callback is a progress or completion callback which is waiting to be invoked.
+type callback struct {
+	fn   func(path string, n int64)
+	path string
+	n    int64
+}
+
+// acquire marks the writer as in use by an operation.
+// It fails if another operation is already in progress.
+func (w *Writer) acquire() error {
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		return ErrConcurrentUse
+	}
+	return nil
+}
+
+// release marks the operation as finished, and then invokes the callbacks queued during the operation.
+// The callbacks are invoked after the writer is released, so that they may use the Writer.
+func (w *Writer) release() {
+	pending := w.pending
+	w.pending = nil
+	atomic.StoreInt32(&w.busy, 0)
+	for _, c := range pending {
+		c.fn(c.path, c.n)
+	}
+}
+
+// notify queues a callback (if set) to be invoked when the current operation finishes.
+func (w *Writer) notify(fn func(path string, n int64), path string, n int64) {
+	if fn != nil {
+		w.pending = append(w.pending, callback{fn, path, n})
+	}
+}
+
+// ErrFileOpen indicates that a file stream was requested before the previous file stream was closed.
+var ErrFileOpen = errors.New("attempted to open a file stream before finishing the previous")
+
+// file creates a new file stream with the given header.
+func (w *Writer) file(hdr fileHeader) (*fileWriter, error) {
 	if w.writing {
-		return nil, errors.New("attempted to open a file stream before finishing the previous")
+		return nil, ErrFileOpen
+	}
+	hdr.Path, hdr.HardlinkTo = filepath.ToSlash(hdr.Path), filepath.ToSlash(hdr.HardlinkTo)
+	if w.strict {
+		err := checkPath(hdr.Path)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.HardlinkTo != "" {
+			err = checkPath(hdr.HardlinkTo)
+			if err != nil {
+				return nil, fmt.Errorf("hard link target: %w", err)
+			}
+		}
+	}
+	if w.dirs != nil {
+		err := w.autoDirs(hdr.Path)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Mode.IsDir() {
+			w.dirs[path.Clean(hdr.Path)] = true
+		}
 	}
 	w.writing = true
 	w.curFile++
-	return &fileWriter{
+	w.stats.Files++
+	w.cur = &fileWriter{
 		stream: w,
-		hdr: fileHeader{
-			Path:  path,
-			Mode:  opts.Permissions,
-			User:  opts.User,
-			Group: opts.Group,
-		},
+		hdr:    hdr,
 		fileNo: w.curFile,
-	}, nil
+	}
+	return w.cur, nil
+}
+
+// autoDirs writes entries for the parent directories of a path which are not yet in the stream.
+func (w *Writer) autoDirs(p string) error {
+	var missing []string
+	for dir := path.Dir(path.Clean(p)); dir != "." && dir != "/" && !w.dirs[dir]; dir = path.Dir(dir) {
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := w.directory(missing[i], FileOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Directory creates a directory in the stream with the given path.
 func (w *Writer) Directory(path string, opts FileOptions) error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
+
+	return w.directory(path, opts)
+}
+
+// directory creates a directory in the stream with the given path.
+func (w *Writer) directory(path string, opts FileOptions) error {
 	opts.Permissions |= os.ModeDir
+	opts.Compression = ""
 
-	f, err := w.File(path, opts)
+	f, err := w.openFile(path, opts)
 	if err != nil {
 		return err
 	}
 
-	err = f.Close()
+	err = f.close()
 	if err != nil {
 		return err
 	}
@@ -130,99 +677,529 @@ func (w *Writer) Directory(path string, opts FileOptions) error {
 	return nil
 }
 
-// ErrWriteInterrupted indicates that a close operation interrupted a file stream and may have resulted in a corrupted stream.
-var ErrWriteInterrupted = errors.New("write interrupted")
-
-// Close ends the stream.
-// If a file stream is incomplete, generates a corrupted stream and returns ErrWriteInterrupted.
-func (w *Writer) Close() error {
-	// mark as closed
-	w.closed = true
+// Hardlink creates an entry in the stream at the given path which is a hard link to target.
+// The target should be the path of a file which has already been written to the stream.
+// Hard link entries have no body.
+func (w *Writer) Hardlink(path string, target string, opts FileOptions) error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
 
-	// do not terminate incomplete writes
-	if w.writing {
-		return ErrWriteInterrupted
+	if target == "" {
+		return errors.New("missing hard link target")
+	}
+	if strings.Contains(target, "\x00") {
+		return errors.New("illegal null character in hard link target")
 	}
 
-	// write terminating header
-	err := json.NewEncoder(&w.w).Encode(fileHeader{
-		Path: "\x00",
-	})
+	hdr := opts.header(path)
+	hdr.HardlinkTo = target
+	f, err := w.file(hdr)
 	if err != nil {
-		return fmt.Errorf("failed to terminate stream: %s", err)
+		return err
 	}
-	err = w.w.WriteByte('\x00')
+
+	err = f.close()
 	if err != nil {
-		return fmt.Errorf("failed to terminate stream: %s", err)
+		return err
 	}
 
-	// flush stream to compressor
-	err = w.w.Flush()
+	return nil
+}
+
+// Special creates a special file in the stream, which has no body.
+// The type of the file is set by the type bits of opts.Permissions, which may be os.ModeNamedPipe for a FIFO, or os.ModeDevice for a block device (with os.ModeCharDevice for a character device).
+// The major and minor device numbers are only used for devices.
+func (w *Writer) Special(path string, major, minor uint32, opts FileOptions) error {
+	err := w.acquire()
 	if err != nil {
-		return fmt.Errorf("failed to terminate stream: %s", err)
+		return err
 	}
+	defer w.release()
 
-	// flush compressor
-	if w.closer != nil {
-		err = w.closer.Close()
-		if err != nil {
-			return fmt.Errorf("failed to terminate stream: %s", err)
-		}
+	switch opts.Permissions & os.ModeType {
+	case os.ModeNamedPipe:
+		major, minor = 0, 0
+	case os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+	case os.ModeSocket:
+		return errors.New("sockets are not supported")
+	default:
+		return fmt.Errorf("unsupported special file type %s", opts.Permissions.Type())
 	}
 
-	return nil
+	hdr := opts.header(path)
+	hdr.Major, hdr.Minor = major, minor
+	f, err := w.file(hdr)
+	if err != nil {
+		return err
+	}
+
+	return f.close()
 }
 
-func (w *Writer) write(file uint64, dat []byte) (int, error) {
-	// check that stream is open
-	if w.closed {
-		return 0, errors.New("filestream closed")
+// CopyRaw copies a file from a Reader created by NewRawReader into the stream, without decompressing or recompressing the body.
+// The rest of the file must not have been read yet.
+// The source stream must use the same framing as this stream (checksums and varint framing), and per-file compression must be enabled if the file is compressed.
+// Progress callbacks are not invoked for raw copies.
+func (w *Writer) CopyRaw(fr *FileReader) error {
+	err := w.acquire()
+	if err != nil {
+		return err
 	}
+	defer w.release()
 
-	// check that file is correct
-	if file != w.curFile || !w.writing {
-		return 0, errors.New("writing to file that has already been closed")
+	if !fr.reader.raw {
+		return errors.New("file is not from a raw reader")
+	}
+	if fr.reader.checksums != w.checksums || fr.reader.varint != w.varint || (fr.reader.hdr.Sparse && !w.sparse) {
+		return errors.New("incompatible chunk framing")
+	}
+	if fr.hdr.Compression != "" && !w.perFile {
+		return errors.New("per-file compression is not enabled")
 	}
 
-	// write length of chunk
-	_, err := w.w.WriteString(strconv.Itoa(len(dat)))
+	_, err = w.file(fr.hdr)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	err = w.w.WriteByte('\x00')
+
+	err = w.startFile(fr.hdr)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	// write data
-	n, err := w.w.Write(dat)
+	_, err = io.Copy(&w.w, fr)
 	if err != nil {
-		return n, err
+		return err
 	}
 
-	return len(dat), nil
+	w.writing = false
+
+	return nil
 }
 
-func (w *Writer) startFile(hdr fileHeader) error {
+// Stats returns totals of the data written to the stream so far.
+// StreamBytes only includes data which has been flushed to the destination, so it is only complete after Close.
+// The bodies of files copied with CopyRaw are not included in BodyBytes.
+func (w *Writer) Stats() Stats {
+	s := w.stats
+	s.StreamBytes = w.dst.n
+	return s
+}
+
+// flusher is a writer which can flush buffered data.
+type flusher interface {
+	Flush() error
+}
+
+// offset returns the current offset into the stream.
+// This is only meaningful for uncompressed and unencrypted streams.
+func (w *Writer) offset() int64 {
+	return w.dst.n + int64(w.w.Buffered())
+}
+
+// Flush flushes all data written so far through to the destination, including data buffered by compression or encryption.
+// It may be called between files, or while writing a file.
+// Flushing frequently may reduce the compression ratio.
+func (w *Writer) Flush() error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
+
 	if w.closed {
 		return errors.New("filestream closed")
 	}
 
-	if strings.Contains(hdr.Path, "\x00") {
-		return errors.New("illegal null character in file path")
+	// flush per-file compressor
+	if w.writing && w.cur.z != nil {
+		if f, ok := w.cur.z.(flusher); ok {
+			err := f.Flush()
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	err := json.NewEncoder(&w.w).Encode(hdr)
+	// send a partial chunk
+	err = w.flushChunk()
 	if err != nil {
-		return fmt.Errorf("failed to start file stream: %s", err)
+		return err
 	}
-	err = w.w.WriteByte('\x00')
+
+	// flush stream buffer, then the compressor and encrypter, then the output buffer
+	err = w.w.Flush()
 	if err != nil {
-		return fmt.Errorf("failed to start file stream: %s", err)
+		return err
 	}
-
-	return nil
-}
+	for _, f := range w.flushers {
+		err = f.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if w.out != &w.w {
+		err = w.out.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ErrWriteInterrupted indicates that a close operation interrupted a file stream and may have resulted in a corrupted stream.
+var ErrWriteInterrupted = errors.New("write interrupted")
+
+// Close ends the stream.
+// If a file stream is incomplete, generates a corrupted stream and returns ErrWriteInterrupted.
+// Closing a stream which has already been closed or aborted returns an error.
+func (w *Writer) Close() error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
+
+	if w.closed {
+		return errors.New("filestream closed")
+	}
+
+	// mark as closed
+	w.closed = true
+
+	// do not terminate incomplete writes
+	if w.writing {
+		return ErrWriteInterrupted
+	}
+
+	// write terminating header
+	if w.compactTerminator {
+		err = w.w.WriteByte('\x00')
+		if err == nil {
+			w.stats.HeaderBytes++
+		}
+	} else {
+		err = w.writeHeader(fileHeader{
+			Path: "\x00",
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to terminate stream: %w", err)
+	}
+
+	// write index and its offset
+	if w.indexed {
+		off := w.offset()
+		err = w.writeHeader(streamIndex{Files: w.index})
+		if err != nil {
+			return fmt.Errorf("failed to write index: %w", err)
+		}
+		var footer [indexFooterSize]byte
+		binary.BigEndian.PutUint64(footer[:], uint64(off))
+		_, err = w.w.Write(footer[:])
+		if err != nil {
+			return fmt.Errorf("failed to write index: %w", err)
+		}
+	}
+
+	// flush stream to compressor
+	err = w.w.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to terminate stream: %w", err)
+	}
+
+	// flush compressor and encrypter
+	if w.closer != nil {
+		err = w.closer.Close()
+		if err != nil {
+			return fmt.Errorf("failed to terminate stream: %w", err)
+		}
+	}
+
+	// flush output buffer
+	if w.out != &w.w {
+		err = w.out.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to terminate stream: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Abort abandons the stream without terminating it, and releases the compressor and encrypter.
+// Data which has not yet been flushed is discarded, so the stream is left truncated.
+// After Abort, the writer and any open file can no longer be used.
+func (w *Writer) Abort() error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
+
+	if w.closed {
+		return errors.New("filestream closed")
+	}
+
+	// mark as closed
+	w.closed = true
+	w.writing = false
+
+	// discard buffered data
+	w.w.Reset(ioutil.Discard)
+	w.chunk = w.chunk[:0]
+	if w.out != &w.w {
+		// the compressor and encrypter write into w.out, so this must happen before they are closed
+		w.out.Reset(ioutil.Discard)
+	}
+
+	// release compressor and encrypter, discarding anything they emit
+	if w.closer != nil {
+		err := w.closer.Close()
+		if err != nil {
+			return fmt.Errorf("failed to abort stream: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// write writes data to the body of a file, which is terminated by writing no data.
+// If a chunk size is set, the data is buffered into chunks of that size.
+// Otherwise, if a minimum chunk size is set, small writes are buffered until there is enough data for a chunk.
+func (w *Writer) write(file uint64, dat []byte) (int, error) {
+	if w.chunkSize <= 0 && w.minChunkSize <= 0 {
+		return w.writeChunk(file, dat)
+	}
+
+	// check that the file can be written
+	err := w.check(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// send the rest of the data before the terminator
+	if len(dat) == 0 {
+		err = w.flushChunk()
+		if err != nil {
+			return 0, err
+		}
+		return w.writeChunk(file, nil)
+	}
+
+	n := len(dat)
+	if w.chunkSize <= 0 {
+		// send large writes directly if nothing is buffered
+		if len(w.chunk) == 0 && len(dat) >= w.minChunkSize {
+			_, err = w.writeChunk(file, dat)
+			if err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+
+		w.chunk = append(w.chunk, dat...)
+		if len(w.chunk) >= w.minChunkSize {
+			err = w.flushChunk()
+			if err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	}
+	for len(dat) > 0 {
+		// send full chunks directly if nothing is buffered
+		if len(w.chunk) == 0 && len(dat) >= w.chunkSize {
+			_, err = w.writeChunk(file, dat[:w.chunkSize])
+			if err != nil {
+				return 0, err
+			}
+			dat = dat[w.chunkSize:]
+			continue
+		}
+
+		if w.chunk == nil {
+			w.chunk = make([]byte, 0, w.chunkSize)
+		}
+		c := copy(w.chunk[len(w.chunk):w.chunkSize], dat)
+		w.chunk = w.chunk[:len(w.chunk)+c]
+		dat = dat[c:]
+		if len(w.chunk) == w.chunkSize {
+			err = w.flushChunk()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flushChunk sends the buffered data of the current file as a chunk.
+func (w *Writer) flushChunk() error {
+	if len(w.chunk) == 0 {
+		return nil
+	}
+	_, err := w.writeChunk(w.curFile, w.chunk)
+	w.chunk = w.chunk[:0]
+	return err
+}
+
+// writeChunk writes data to the body of a file as a single chunk.
+func (w *Writer) writeChunk(file uint64, dat []byte) (int, error) {
+	// check that the file can be written
+	err := w.check(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// write length of chunk
+	err = w.writeNum(uint64(len(dat)))
+	if err != nil {
+		return 0, err
+	}
+
+	// write data
+	n, err := w.w.Write(dat)
+	if err != nil {
+		return n, err
+	}
+
+	// write checksum of data
+	if w.checksums && len(dat) > 0 {
+		err = w.writeNum(uint64(crc32.ChecksumIEEE(dat)))
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return len(dat), nil
+}
+
+// check checks that the given file can be written to.
+func (w *Writer) check(file uint64) error {
+	// check that stream is open
+	if w.closed {
+		return errors.New("filestream closed")
+	}
+
+	// check that file is correct
+	if file != w.curFile || !w.writing {
+		return errors.New("writing to file that has already been closed")
+	}
+
+	return nil
+}
+
+// writeNum writes a number in the framing of the stream, as used for chunk lengths and checksums.
+func (w *Writer) writeNum(v uint64) error {
+	_, err := w.w.Write(appendNum(w.num[:0], v, w.varint))
+	return err
+}
+
+// checkPath checks that a path is safe to decode, for strict mode.
+func checkPath(path string) error {
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(path) {
+		return fmt.Errorf("absolute path %q", path)
+	}
+	if strings.Contains(path, "\\") {
+		return fmt.Errorf("illegal backslash in path %q", path)
+	}
+	for _, c := range path {
+		if c < 0x20 {
+			return fmt.Errorf("illegal control character %q in path %q", c, path)
+		}
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return fmt.Errorf("illegal \"..\" component in path %q", path)
+		}
+	}
+	return nil
+}
+
+// appendNum appends a number to a buffer in the given framing.
+func appendNum(dst []byte, v uint64, varint bool) []byte {
+	if varint {
+		var buf [binary.MaxVarintLen64]byte
+		return append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+	}
+	return append(strconv.AppendUint(dst, v, 10), '\x00')
+}
+
+// closeChain is a sequence of closers which are closed in order.
+type closeChain []io.Closer
+
+func (c closeChain) Close() error {
+	for _, cl := range c {
+		err := cl.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerEncoder is a reusable buffer and JSON encoder for headers.
+type headerEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// headerEncoders pools header encoders across writers.
+var headerEncoders = sync.Pool{
+	New: func() interface{} {
+		he := new(headerEncoder)
+		he.enc = json.NewEncoder(&he.buf)
+		return he
+	},
+}
+
+// writeHeader writes a null-terminated JSON header to the stream.
+func (w *Writer) writeHeader(hdr interface{}) error {
+	n, err := writeHeader(&w.w, hdr)
+	w.stats.HeaderBytes += int64(n)
+	return err
+}
+
+// writeHeader encodes a null-terminated JSON header to a writer.
+// It returns the number of bytes written.
+func writeHeader(dst io.Writer, hdr interface{}) (int, error) {
+	he := headerEncoders.Get().(*headerEncoder)
+	defer headerEncoders.Put(he)
+	he.buf.Reset()
+	err := he.enc.Encode(hdr)
+	if err != nil {
+		return 0, err
+	}
+	he.buf.WriteByte('\x00')
+	return dst.Write(he.buf.Bytes())
+}
+
+func (w *Writer) startFile(hdr fileHeader) error {
+	if w.closed {
+		return errors.New("filestream closed")
+	}
+
+	if strings.Contains(hdr.Path, "\x00") {
+		return errors.New("illegal null character in file path")
+	}
+
+	if w.indexed {
+		w.index = append(w.index, indexEntry{hdr.Path, w.offset()})
+	}
+
+	err := w.writeHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to start file stream: %w", err)
+	}
+
+	return nil
+}
 
 // fileWriter is a stream for writing a file.
 type fileWriter struct {
@@ -230,10 +1207,47 @@ type fileWriter struct {
 	fileNo  uint64
 	started bool
 	hdr     fileHeader
+
+	// z is the compressor for the file body, if the file is compressed
+	z io.WriteCloser
+
+	// written is the number of bytes which have been written to the file
+	written int64
+
+	// reported is the number of bytes of the file which were last reported to the progress callback
+	reported int64
+}
+
+// reportProgress notifies the progress callback if at least the progress interval has been written since the last report.
+func (fw *fileWriter) reportProgress() {
+	if fw.written-fw.reported < fw.stream.interval {
+		return
+	}
+	fw.reported = fw.written
+	fw.stream.notify(fw.stream.progress, fw.hdr.Path, fw.written)
+}
+
+// finishProgress reports the final size of the file, if it has not already been reported.
+func (fw *fileWriter) finishProgress() {
+	if fw.written != fw.reported {
+		fw.reported = fw.written
+		fw.stream.notify(fw.stream.progress, fw.hdr.Path, fw.written)
+	}
 }
 
 // Write writes the data to the file stream.
 func (fw *fileWriter) Write(data []byte) (int, error) {
+	err := fw.stream.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer fw.stream.release()
+
+	return fw.write(data)
+}
+
+// write writes the data to the file stream.
+func (fw *fileWriter) write(data []byte) (int, error) {
 	if !fw.started {
 		fw.started = true
 		err := fw.stream.startFile(fw.hdr)
@@ -246,14 +1260,120 @@ func (fw *fileWriter) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 
-	return fw.stream.write(fw.fileNo, data)
+	var n int
+	var err error
+	if fw.z != nil {
+		n, err = fw.z.Write(data)
+	} else {
+		n, err = fw.stream.write(fw.fileNo, data)
+	}
+	fw.written += int64(n)
+	fw.stream.stats.BodyBytes += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	fw.reportProgress()
+
+	return n, nil
+}
+
+// ReadFrom writes the data from r to the file stream until EOF.
+// Each read is sent as a chunk, using a pooled buffer rather than the buffer which io.Copy would allocate.
+// If r returns data along with an error, the data is written before the error is returned.
+func (fw *fileWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	var total int64
+	for {
+		n, rerr := r.Read(*buf)
+		if n > 0 {
+			wn, err := fw.Write((*buf)[:n])
+			total += int64(wn)
+			if err != nil {
+				return total, err
+			}
+		}
+		switch rerr {
+		case nil:
+		case io.EOF:
+			return total, nil
+		default:
+			return total, rerr
+		}
+	}
+}
+
+// hole writes a hole of n zero bytes to the file stream, without sending the zeros.
+func (fw *fileWriter) hole(n int64) error {
+	err := fw.stream.acquire()
+	if err != nil {
+		return err
+	}
+	defer fw.stream.release()
+
+	if !fw.stream.sparse {
+		return errors.New("sparse files are not enabled for this stream")
+	}
+	if fw.z != nil {
+		return errors.New("holes are not supported in compressed files")
+	}
+	if !fw.started {
+		_, err := fw.write(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = fw.stream.check(fw.fileNo)
+	if err != nil {
+		return err
+	}
+	err = fw.stream.flushChunk()
+	if err != nil {
+		return err
+	}
+	err = fw.stream.writeNum(holeChunk)
+	if err != nil {
+		return err
+	}
+	err = fw.stream.writeNum(uint64(n))
+	if err != nil {
+		return err
+	}
+	fw.written += n
+	fw.stream.stats.BodyBytes += n
+
+	fw.reportProgress()
+
+	return nil
 }
 
 // Close closes a file stream.
 func (fw *fileWriter) Close() error {
+	err := fw.stream.acquire()
+	if err != nil {
+		return err
+	}
+	defer fw.stream.release()
+
+	return fw.close()
+}
+
+// close closes a file stream.
+func (fw *fileWriter) close() error {
 	// for 0 length files, start the stream
 	if !fw.started {
-		_, err := fw.Write(nil)
+		_, err := fw.write(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// flush compressor
+	if fw.z != nil {
+		err := fw.z.Close()
 		if err != nil {
 			return err
 		}
@@ -268,5 +1388,230 @@ func (fw *fileWriter) Close() error {
 	// mark as no longer writing
 	fw.stream.writing = false
 
+	fw.finishProgress()
+	fw.stream.notify(fw.stream.fileDone, fw.hdr.Path, fw.written)
+
 	return nil
 }
+
+// WriteFile writes a complete file to the stream.
+// Unless the file is compressed, the size is stored in the file header and the body is sent as a single chunk, as with FileN.
+func (w *Writer) WriteFile(path string, data []byte, opts FileOptions) error {
+	err := w.acquire()
+	if err != nil {
+		return err
+	}
+	defer w.release()
+
+	var fw interface {
+		write([]byte) (int, error)
+		close() error
+	}
+	if opts.Compression == "" {
+		fw, err = w.fileN(path, int64(len(data)), opts)
+	} else {
+		fw, err = w.openFile(path, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	// an empty write would terminate the file early
+	if len(data) > 0 {
+		_, err = fw.write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fw.close()
+}
+
+// ErrOverflow indicates that a write to a file created with FileN would exceed the declared size of the file.
+var ErrOverflow = errors.New("write exceeds declared file size")
+
+// ErrShortWrite indicates that a file created with FileN was closed before the declared size was written.
+var ErrShortWrite = errors.New("file closed before declared size was written")
+
+// FileN creates a new file stream at the given path for a file of a known size.
+// The size is stored in the file header, and the body is sent as a single chunk rather than a chunk per write.
+// Exactly size bytes must be written to the file before it is closed.
+// A write which would exceed the size fails with ErrOverflow, and writes nothing.
+// Closing the file before the size has been written fails with ErrShortWrite, and leaves the stream incomplete, so the Writer must be aborted.
+// Per-file compression is not supported, as the compressed size is not known ahead of time.
+func (w *Writer) FileN(path string, size int64, opts FileOptions) (io.WriteCloser, error) {
+	err := w.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer w.release()
+
+	sw, err := w.fileN(path, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// fileN creates a new file stream at the given path for a file of a known size.
+func (w *Writer) fileN(path string, size int64, opts FileOptions) (*sizedWriter, error) {
+	if size < 0 {
+		return nil, errors.New("negative file size")
+	}
+	if opts.Compression != "" {
+		return nil, errors.New("per-file compression is not supported for files of a known size")
+	}
+
+	hdr := opts.header(path)
+	hdr.Size = &size
+	fw, err := w.file(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sizedWriter{
+		fw:  fw,
+		rem: size,
+	}, nil
+}
+
+// sizedWriter is a stream for writing a file of a known size as a single chunk.
+type sizedWriter struct {
+	fw *fileWriter
+
+	// rem is the remaining number of bytes to be written
+	rem int64
+
+	// crc is the checksum of the data written so far
+	crc uint32
+}
+
+// Write writes the data to the file stream.
+func (sw *sizedWriter) Write(data []byte) (int, error) {
+	err := sw.fw.stream.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer sw.fw.stream.release()
+
+	return sw.write(data)
+}
+
+// write writes the data to the file stream.
+func (sw *sizedWriter) write(data []byte) (int, error) {
+	fw := sw.fw
+	if !fw.started {
+		fw.started = true
+		err := fw.stream.startFile(fw.hdr)
+		if err != nil {
+			return 0, err
+		}
+
+		// start the chunk containing the whole body
+		if sw.rem > 0 {
+			err = fw.stream.check(fw.fileNo)
+			if err != nil {
+				return 0, err
+			}
+			err = fw.stream.writeNum(uint64(sw.rem))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if int64(len(data)) > sw.rem {
+		return 0, fmt.Errorf("write of %d bytes to %q with %d bytes remaining of %d: %w", len(data), fw.hdr.Path, sw.rem, *fw.hdr.Size, ErrOverflow)
+	}
+
+	err := fw.stream.check(fw.fileNo)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fw.stream.w.Write(data)
+	sw.rem -= int64(n)
+	sw.crc = crc32.Update(sw.crc, crc32.IEEETable, data[:n])
+	fw.written += int64(n)
+	fw.stream.stats.BodyBytes += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	fw.reportProgress()
+
+	return n, nil
+}
+
+// Close closes the file stream.
+// If fewer bytes than the declared size were written, the stream is left incomplete and an error is returned.
+func (sw *sizedWriter) Close() error {
+	err := sw.fw.stream.acquire()
+	if err != nil {
+		return err
+	}
+	defer sw.fw.stream.release()
+
+	return sw.close()
+}
+
+// close closes the file stream.
+func (sw *sizedWriter) close() error {
+	fw := sw.fw
+
+	// for 0 length files, start the stream
+	if !fw.started {
+		_, err := sw.write(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the file may already have been closed
+	err := fw.stream.check(fw.fileNo)
+	if err != nil {
+		return err
+	}
+
+	if sw.rem > 0 {
+		return fmt.Errorf("file %q closed %d bytes short of declared size of %d bytes: %w", fw.hdr.Path, sw.rem, *fw.hdr.Size, ErrShortWrite)
+	}
+
+	// write checksum of body
+	if fw.stream.checksums && *fw.hdr.Size > 0 {
+		err := fw.stream.writeNum(uint64(sw.crc))
+		if err != nil {
+			return err
+		}
+	}
+
+	// write terminating 0 length chunk
+	_, err = fw.stream.write(fw.fileNo, nil)
+	if err != nil {
+		return err
+	}
+
+	// mark as no longer writing
+	fw.stream.writing = false
+
+	fw.finishProgress()
+	fw.stream.notify(fw.stream.fileDone, fw.hdr.Path, fw.written)
+
+	return nil
+}
+
+// chunkWriter writes compressed data to a file stream as chunks.
+type chunkWriter struct {
+	fw *fileWriter
+}
+
+func (cw chunkWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	return cw.fw.stream.write(cw.fw.fileNo, data)
+}
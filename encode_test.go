@@ -0,0 +1,1285 @@
+package filestream_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestWriterProgress(t *testing.T) {
+	type report struct {
+		Path  string
+		Bytes int64
+	}
+	var progress, done []report
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{
+		Progress: func(path string, bytesWritten int64) {
+			progress = append(progress, report{path, bytesWritten})
+		},
+		FileDone: func(path string, bytesWritten int64) {
+			done = append(done, report{path, bytesWritten})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("hello.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"hello", " ", "world"} {
+		_, err = fw.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectProgress := []report{
+		{"hello.txt", 5},
+		{"hello.txt", 6},
+		{"hello.txt", 11},
+	}
+	if diff := cmp.Diff(expectProgress, progress); diff != "" {
+		t.Errorf("unexpected progress: (-expect +got): %s", diff)
+	}
+	expectDone := []report{
+		{"hello.txt", 11},
+		{"dir", 0},
+	}
+	if diff := cmp.Diff(expectDone, done); diff != "" {
+		t.Errorf("unexpected file completions: (-expect +got): %s", diff)
+	}
+}
+
+func TestFileOpen(t *testing.T) {
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.File("a.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.File("b.txt", filestream.FileOptions{})
+	if !errors.Is(err, filestream.ErrFileOpen) {
+		t.Errorf("expected ErrFileOpen but got %v", err)
+	}
+}
+
+func TestFileN(t *testing.T) {
+	for _, sopts := range []filestream.StreamOptions{{}, {Checksums: true}} {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, sopts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := w.FileN("hello.txt", 11, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range []string{"hello", " ", "world"} {
+			_, err = fw.Write([]byte(chunk))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err = w.FileN("empty.txt", 0, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err = w.File("chunked.txt", filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("chunked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the single chunk should not be split
+		if n := bytes.Count(buf.Bytes(), []byte("hello world")); n != 1 {
+			t.Errorf("expected body to be stored as one chunk")
+		}
+
+		r, err := filestream.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for r.Next() {
+			dat, err := ioutil.ReadAll(r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[r.File().Path()] = string(dat)
+		}
+		if err = r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		expect := map[string]string{
+			"hello.txt":   "hello world",
+			"empty.txt":   "",
+			"chunked.txt": "chunked",
+		}
+		if diff := cmp.Diff(expect, got); diff != "" {
+			t.Errorf("unexpected files: (-expect +got): %s", diff)
+		}
+	}
+}
+
+func TestFileNSize(t *testing.T) {
+	t.Run("Exact", func(t *testing.T) {
+		w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{Checksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := w.FileN("file.txt", 5, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fw.Close() == nil {
+			t.Error("closed file twice")
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Under", func(t *testing.T) {
+		w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Abort()
+		fw, err := w.FileN("file.txt", 5, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("hel"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if !errors.Is(err, filestream.ErrShortWrite) {
+			t.Errorf("expected ErrShortWrite but got %v", err)
+		}
+	})
+	t.Run("Over", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := w.FileN("file.txt", 5, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("hel"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := fw.Write([]byte("lo world"))
+		if !errors.Is(err, filestream.ErrOverflow) {
+			t.Errorf("expected ErrOverflow but got %v", err)
+		}
+		if n != 0 {
+			t.Errorf("overflowing write wrote %d bytes", n)
+		}
+
+		// the file can still be completed
+		_, err = fw.Write([]byte("lo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := filestream.DecodeToMap(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got["file.txt"]) != "hello" {
+			t.Errorf("expected %q but got %q", "hello", got["file.txt"])
+		}
+	})
+}
+
+func TestWriteFile(t *testing.T) {
+	files := []struct {
+		Path, Data, Compression string
+	}{
+		{"hello.txt", "hello world", ""},
+		{"empty.txt", "", ""},
+		{"compressed.txt", "hello hello hello", "gzip"},
+		{"compressed-empty.txt", "", "lz4"},
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{PerFileCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		err = w.WriteFile(f.Path, []byte(f.Data), filestream.FileOptions{Compression: f.Compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !r.Next() {
+			t.Fatalf("missing file %q: %v", f.Path, r.Err())
+		}
+		fr := r.File()
+		dat, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Path() != f.Path || string(dat) != f.Data {
+			t.Errorf("expected %q with %q but got %q with %q", f.Path, f.Data, fr.Path(), string(dat))
+		}
+		if size, ok := fr.Size(); f.Compression == "" && (!ok || size != int64(len(f.Data))) {
+			t.Errorf("missing or incorrect size on %q", f.Path)
+		}
+	}
+	if r.Next() {
+		t.Errorf("unexpected file %q", r.File().Path())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictPaths(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Path   string
+		Target string
+	}{
+		{"Absolute", "/etc/passwd", ""},
+		{"Parent", "../escape.txt", ""},
+		{"NestedParent", "a/../../escape.txt", ""},
+		{"Backslash", `a\b.txt`, ""},
+		{"ControlCharacter", "a\nb.txt", ""},
+		{"LinkTarget", "link.txt", "../escape.txt"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{StrictPaths: strict})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.Target != "" {
+					err = w.Hardlink(tc.Path, tc.Target, filestream.FileOptions{})
+				} else {
+					err = w.WriteFile(tc.Path, []byte("data"), filestream.FileOptions{})
+				}
+				switch {
+				case strict && err == nil:
+					t.Errorf("accepted path %q in strict mode", tc.Path)
+				case !strict && err != nil:
+					t.Errorf("rejected path %q in lenient mode: %s", tc.Path, err)
+				}
+			}
+		})
+	}
+
+	// rejected paths do not leave a file open
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{StrictPaths: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.WriteFile("../invalid", nil, filestream.FileOptions{}) == nil {
+		t.Error("accepted invalid path in strict mode")
+	}
+	for _, path := range []string{".", "a/b.txt", "..a/b..", "dir/.hidden"} {
+		err = w.WriteFile(path, nil, filestream.FileOptions{})
+		if err != nil {
+			t.Errorf("rejected valid path %q: %s", path, err)
+		}
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		Name string
+		Opts filestream.StreamOptions
+		File filestream.FileOptions
+	}{
+		{"Uncompressed", filestream.StreamOptions{}, filestream.FileOptions{}},
+		{"Gzip", filestream.StreamOptions{Compression: "gzip"}, filestream.FileOptions{}},
+		{"LZ4", filestream.StreamOptions{Compression: "lz4"}, filestream.FileOptions{}},
+		{"Brotli", filestream.StreamOptions{Compression: "brotli"}, filestream.FileOptions{}},
+		{"Encrypted", filestream.StreamOptions{Compression: "gzip", Encryption: &filestream.Encryption{Key: key}}, filestream.FileOptions{}},
+		{"PerFile", filestream.StreamOptions{PerFileCompression: true}, filestream.FileOptions{Compression: "gzip"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			defer pr.Close()
+
+			// read from the stream as data arrives
+			reads := make(chan string, 2)
+			errs := make(chan error, 1)
+			go func() {
+				r, err := filestream.NewReaderWithOptions(pr, filestream.ReaderOptions{Encryption: tc.Opts.Encryption})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !r.Next() {
+					errs <- r.Err()
+					return
+				}
+				buf := make([]byte, len("hello"))
+				for i := 0; i < 2; i++ {
+					_, err = io.ReadFull(r.File(), buf)
+					if err != nil {
+						errs <- err
+						return
+					}
+					reads <- string(buf)
+				}
+
+				// keep draining so that the writer does not block
+				io.Copy(ioutil.Discard, pr)
+			}()
+			expect := func(s string) {
+				t.Helper()
+				select {
+				case got := <-reads:
+					if got != s {
+						t.Errorf("expected %q but got %q", s, got)
+					}
+				case err := <-errs:
+					t.Fatalf("failed to read: %v", err)
+				case <-time.After(10 * time.Second):
+					t.Fatal("flushed data was not received")
+				}
+			}
+
+			w, err := filestream.NewWriter(pw, tc.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw, err := w.File("hello.txt", tc.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{"hello", "world"} {
+				_, err = fw.Write([]byte(s))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = w.Flush()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expect(s)
+			}
+		})
+	}
+}
+
+func TestWriterLayering(t *testing.T) {
+	// a large payload immediately after the stream header, written in a single call
+	payload := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	tests := []struct {
+		Name string
+		Opts filestream.StreamOptions
+	}{
+		{"Uncompressed", filestream.StreamOptions{}},
+		{"Gzip", filestream.StreamOptions{Compression: "gzip"}},
+		{"LZ4", filestream.StreamOptions{Compression: "lz4"}},
+		{"Encrypted", filestream.StreamOptions{Encryption: &filestream.Encryption{Key: bytes.Repeat([]byte{1}, 32)}}},
+		{"GzipEncrypted", filestream.StreamOptions{Compression: "gzip", Encryption: &filestream.Encryption{Key: bytes.Repeat([]byte{1}, 32)}}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, tc.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("big.bin", payload, filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the stream header must come first, intact
+			hdrLen := bytes.IndexByte(buf.Bytes(), 0)
+			if hdrLen < 0 || !bytes.HasPrefix(buf.Bytes(), []byte(`{"version":`)) {
+				t.Fatalf("stream does not start with a header: %q", buf.Bytes()[:32])
+			}
+
+			r, err := filestream.NewReaderWithOptions(&buf, filestream.ReaderOptions{Encryption: tc.Opts.Encryption})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !r.Next() {
+				t.Fatalf("missing file: %v", r.Err())
+			}
+			got, err := ioutil.ReadAll(r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Error("payload corrupted")
+			}
+			if r.Next() {
+				t.Errorf("unexpected file %q", r.File().Path())
+			}
+			if err := r.Err(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAppendWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "filestream-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	opts := filestream.StreamOptions{Checksums: true}
+	w, err := filestream.NewWriter(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("first.txt", []byte("first"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// append a file in each session
+	for _, path := range []string{"second.txt", "third.txt"} {
+		w, err := filestream.NewAppendWriter(f, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WriteFile(path, []byte(strings.TrimSuffix(path, ".txt")), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := filestream.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for r.Next() {
+		dat, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[r.File().Path()] = string(dat)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"first.txt":  "first",
+		"second.txt": "second",
+		"third.txt":  "third",
+	}
+	if diff := cmp.Diff(expect, files); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+	// mismatched options must be rejected
+	_, err = filestream.NewAppendWriter(f, filestream.StreamOptions{})
+	if err == nil {
+		t.Error("appended to a stream with mismatched checksum options")
+	}
+	_, err = filestream.NewAppendWriter(f, filestream.StreamOptions{Checksums: true, Compression: "gzip"})
+	if err == nil {
+		t.Error("appended to a stream with compression")
+	}
+}
+
+func TestAppendStream(t *testing.T) {
+	sub, err := filestream.EncodeToBytes(map[string][]byte{
+		"a.txt":     []byte("a"),
+		"dir/b.txt": []byte("b"),
+	}, filestream.StreamOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("first.txt", []byte("first"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AppendStreamAt(bytes.NewReader(sub), "pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := filestream.DecodeToMap(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]byte{
+		"first.txt":     []byte("first"),
+		"pkg/a.txt":     []byte("a"),
+		"pkg/dir/b.txt": []byte("b"),
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+}
+
+func TestParallelGzip(t *testing.T) {
+	// enough data for several blocks, with a partial block at the end
+	data := make([]byte, 3<<20+12345)
+	rng := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(16))
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{
+		Compression:            "gzip",
+		CompressionConcurrency: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("first.bin", data, filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("second.bin", data[:1000], filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the body must be a single gzip member readable by the standard library
+	body := buf.Bytes()[bytes.IndexByte(buf.Bytes(), 0)+1:]
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr.Multistream(false)
+	_, err = io.Copy(ioutil.Discard, zr)
+	if err != nil {
+		t.Fatalf("failed to decompress with the standard gzip reader: %v", err)
+	}
+
+	r, err := filestream.NewReaderWithOptions(bytes.NewReader(buf.Bytes()), filestream.ReaderOptions{AllowTrailingData: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range [][]byte{data, data[:1000]} {
+		if !r.Next() {
+			t.Fatalf("missing file: %v", r.Err())
+		}
+		got, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expect) {
+			t.Errorf("file %q corrupted", r.File().Path())
+		}
+	}
+	if r.Next() {
+		t.Errorf("unexpected file %q", r.File().Path())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLZ4Options(t *testing.T) {
+	// compressible data spanning several 64 KiB blocks
+	data := make([]byte, 200<<10)
+	rng := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(4))
+	}
+	opts := filestream.StreamOptions{
+		Compression: "lz4",
+		LZ4:         &filestream.LZ4Options{BlockChecksum: true, BlockSize: 64 << 10},
+	}
+	dat, err := filestream.EncodeToBytes(map[string][]byte{"file.txt": data}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the options are recorded in the frame descriptor
+	frame := bytes.Index(dat, []byte{0x04, 0x22, 0x4d, 0x18})
+	if frame < 0 {
+		t.Fatal("lz4 frame not found")
+	}
+	if flags := dat[frame+4]; flags&(1<<4) == 0 || flags&(1<<2) == 0 {
+		t.Errorf("expected block and content checksums, but the frame flags are %08b", flags)
+	}
+	if bd := dat[frame+5]; bd != 4<<4 {
+		t.Errorf("expected 64 KiB blocks, but the block descriptor is %08b", bd)
+	}
+
+	got, err := filestream.DecodeToMap(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got["file.txt"], data) {
+		t.Error("data changed through lz4 with checksums")
+	}
+
+	// corruption within a block is detected by the block checksum
+	bad := append([]byte(nil), dat...)
+	bad[frame+7+4+100] ^= 0xff
+	_, err = filestream.DecodeToMap(bad)
+	if err == nil || !strings.Contains(err.Error(), "block checksum") {
+		t.Errorf("expected a block checksum error but got %v", err)
+	}
+
+	_, err = filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{Compression: "lz4", LZ4: &filestream.LZ4Options{BlockSize: 1000}})
+	if err == nil {
+		t.Error("accepted an unsupported block size")
+	}
+}
+
+func TestCompressionLevelValidation(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Opts  filestream.StreamOptions
+		Valid bool
+	}{
+		{"GzipBest", filestream.StreamOptions{Compression: "gzip", CompressionLevel: 9}, true},
+		{"GzipHuffman", filestream.StreamOptions{Compression: "gzip", CompressionLevel: -2}, true},
+		{"GzipHigh", filestream.StreamOptions{Compression: "gzip", CompressionLevel: 99}, false},
+		{"GzipLow", filestream.StreamOptions{Compression: "gzip", CompressionLevel: -3}, false},
+		{"ParallelGzipHigh", filestream.StreamOptions{Compression: "gzip", CompressionLevel: 10, CompressionConcurrency: 4}, false},
+		{"LZ4Max", filestream.StreamOptions{Compression: "lz4", CompressionLevel: 1 << 16}, true},
+		{"LZ4High", filestream.StreamOptions{Compression: "lz4", CompressionLevel: 1<<16 + 1}, false},
+		{"LZ4Negative", filestream.StreamOptions{Compression: "lz4", CompressionLevel: -1}, false},
+		{"BrotliBest", filestream.StreamOptions{Compression: "brotli", CompressionLevel: 11}, true},
+		{"BrotliHigh", filestream.StreamOptions{Compression: "brotli", CompressionLevel: 12}, false},
+		{"BrotliNegative", filestream.StreamOptions{Compression: "brotli", CompressionLevel: -1}, false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := filestream.NewWriter(ioutil.Discard, tc.Opts)
+			switch {
+			case tc.Valid && err != nil:
+				t.Errorf("rejected valid level: %v", err)
+			case !tc.Valid && !errors.Is(err, filestream.ErrInvalidCompressionLevel):
+				t.Errorf("expected invalid level error but got %v", err)
+			case !tc.Valid && !strings.Contains(err.Error(), tc.Opts.Compression):
+				t.Errorf("error %q does not name the algorithm", err)
+			}
+		})
+	}
+
+	// per-file compression levels are validated in the same way
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{PerFileCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.File("file.txt", filestream.FileOptions{Compression: "gzip", CompressionLevel: 99})
+	if !errors.Is(err, filestream.ErrInvalidCompressionLevel) {
+		t.Errorf("expected invalid level error but got %v", err)
+	}
+	err = w.WriteFile("file.txt", []byte("still usable"), filestream.FileOptions{})
+	if err != nil {
+		t.Errorf("writer unusable after invalid file options: %v", err)
+	}
+}
+
+func TestAutoDirs(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{AutoDirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("a/b/c.txt", []byte("c"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("a/d", filestream.FileOptions{Permissions: 0700})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("a/d/e.txt", []byte("e"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("top.txt", []byte("top"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("a/b/f.txt", []byte("f"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Path string
+		Dir  bool
+	}
+	var entries []entry
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		fr := r.File()
+		entries = append(entries, entry{fr.Path(), fr.Opts().Permissions.IsDir()})
+		err = fr.Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []entry{
+		{"a", true},
+		{"a/b", true},
+		{"a/b/c.txt", false},
+		{"a/d", true},
+		{"a/d/e.txt", false},
+		{"top.txt", false},
+		{"a/b/f.txt", false},
+	}
+	if diff := cmp.Diff(expect, entries); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestMinChunkSize(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{MinChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("data.json", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"hello":"world","numbers":[1,2,3]}`
+	for i := 0; i < len(body); i++ {
+		_, err = fw.Write([]byte{body[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// empty writes must not end the file or emit a chunk
+		_, err = fw.Write(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the raw body should be a single chunk followed by the terminator
+	r, err := filestream.NewRawReader(&buf, filestream.ReaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatalf("missing file: %v", r.Err())
+	}
+	raw, err := ioutil.ReadAll(r.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("%d\x00%s0\x00", len(body), body)
+	if string(raw) != expect {
+		t.Errorf("expected framed body %q but got %q", expect, raw)
+	}
+	if r.Next() {
+		t.Errorf("unexpected file %q", r.File().Path())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// partialReader returns its data along with an error.
+type partialReader struct {
+	data string
+	err  error
+}
+
+func (pr *partialReader) Read(dst []byte) (int, error) {
+	n := copy(dst, pr.data)
+	pr.data = pr.data[n:]
+	if pr.data == "" {
+		return n, pr.err
+	}
+	return n, nil
+}
+
+func TestFileReadFrom(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// data read along with an error must still be written
+	fw, err := w.File("partial.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errBoom := errors.New("boom")
+	n, err := io.Copy(fw, io.MultiReader(strings.NewReader("hello "), &partialReader{"world", errBoom}))
+	if err != errBoom {
+		t.Errorf("expected source error but got %v", err)
+	}
+	if n != 11 {
+		t.Errorf("expected 11 bytes but got %d", n)
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty source produces an empty file
+	fw, err = w.File("empty.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = io.Copy(fw, strings.NewReader(""))
+	if err != nil || n != 0 {
+		t.Errorf("expected an empty copy but got %d bytes (error: %v)", n, err)
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		data, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[r.File().Path()] = string(data)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"partial.txt": "hello world", "empty.txt": ""}, got); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		Name string
+		Opts filestream.StreamOptions
+	}{
+		{"Plain", filestream.StreamOptions{}},
+		{"Gzip", filestream.StreamOptions{Compression: "gzip"}},
+		{"LZ4", filestream.StreamOptions{Compression: "lz4"}},
+		{"Encrypted", filestream.StreamOptions{Encryption: &filestream.Encryption{Key: key}}},
+	}
+
+	// enough incompressible data to overflow the buffers in front of the compressor and encrypter
+	partial := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(partial)
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, tc.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("done.txt", []byte("done"), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw, err := w.File("partial.txt", filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fw.Write(partial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := buf.Len()
+			err = w.Abort()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != written {
+				t.Errorf("abort wrote %d bytes to the destination", buf.Len()-written)
+			}
+
+			// the writer can no longer be used
+			_, err = fw.Write([]byte("more"))
+			if err == nil {
+				t.Error("wrote to file after abort")
+			}
+			err = w.Close()
+			if err == nil {
+				t.Error("closed stream after abort")
+			}
+
+			// the flushed file is readable, but the stream is not terminated
+			r, err := filestream.NewReaderWithOptions(&buf, filestream.ReaderOptions{Encryption: tc.Opts.Encryption})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !r.Next() {
+				t.Fatalf("failed to read flushed file: %v", r.Err())
+			}
+			if r.File().Path() != "done.txt" {
+				t.Errorf("expected done.txt but got %q", r.File().Path())
+			}
+			for r.Next() {
+				if r.File().Path() != "partial.txt" {
+					t.Errorf("unexpected file %q", r.File().Path())
+				}
+			}
+			if r.Err() == nil {
+				t.Error("aborted stream was terminated")
+			}
+		})
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	for _, compression := range []string{"", "gzip"} {
+		compression := compression
+		t.Run("Compression="+compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: compression, BufferSize: 1 << 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("big.bin", data, filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("small.txt", []byte("small"), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := filestream.NewReaderWithOptions(&buf, filestream.ReaderOptions{BufferSize: 1 << 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expect := range [][]byte{data, []byte("small")} {
+				if !r.Next() {
+					t.Fatalf("missing file: %v", r.Err())
+				}
+				got, err := ioutil.ReadAll(r.File())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, expect) {
+					t.Errorf("file %q was corrupted", r.File().Path())
+				}
+			}
+			if r.Next() {
+				t.Errorf("unexpected file %q", r.File().Path())
+			}
+			if r.Err() != nil {
+				t.Error(r.Err())
+			}
+		})
+	}
+
+	_, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{BufferSize: 16})
+	if !errors.Is(err, filestream.ErrInvalidBufferSize) {
+		t.Errorf("expected ErrInvalidBufferSize from writer but got %v", err)
+	}
+	_, err = filestream.NewReaderWithOptions(strings.NewReader(""), filestream.ReaderOptions{BufferSize: 16})
+	if !errors.Is(err, filestream.ErrInvalidBufferSize) {
+		t.Errorf("expected ErrInvalidBufferSize from reader but got %v", err)
+	}
+}
+
+// blockingWriter is an io.Writer which blocks each write until it is released.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bw blockingWriter) Write(dat []byte) (int, error) {
+	bw.entered <- struct{}{}
+	<-bw.release
+	return len(dat), nil
+}
+
+func TestConcurrentUse(t *testing.T) {
+	t.Run("Overlap", func(t *testing.T) {
+		dst := blockingWriter{make(chan struct{}), make(chan struct{})}
+		w, err := filestream.NewWriter(dst, filestream.StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// hold the writer in a flush which is blocked on the destination
+		done := make(chan error)
+		go func() { done <- w.Flush() }()
+		<-dst.entered
+
+		_, err = w.File("hello.txt", filestream.FileOptions{})
+		if !errors.Is(err, filestream.ErrConcurrentUse) {
+			t.Errorf("expected ErrConcurrentUse but got %v", err)
+		}
+		err = w.Close()
+		if !errors.Is(err, filestream.ErrConcurrentUse) {
+			t.Errorf("expected ErrConcurrentUse but got %v", err)
+		}
+
+		close(dst.release)
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the writer is usable once the flush has finished
+		go func() {
+			for range dst.entered {
+			}
+		}()
+		err = w.WriteFile("hello.txt", []byte("hello"), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(dst.entered)
+	})
+
+	t.Run("Race", func(t *testing.T) {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// race goroutines writing whole files, without any synchronization
+		const goroutines, files = 8, 64
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		written := map[string]bool{}
+		var conflicts int
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < files; i++ {
+					path := fmt.Sprintf("g%d/f%d.txt", g, i)
+					err := w.WriteFile(path, []byte(path), filestream.FileOptions{})
+					mu.Lock()
+					switch {
+					case err == nil:
+						written[path] = true
+					case errors.Is(err, filestream.ErrConcurrentUse):
+						conflicts++
+					default:
+						t.Errorf("unexpected error: %v", err)
+					}
+					mu.Unlock()
+				}
+			}(g)
+		}
+		wg.Wait()
+		t.Logf("%d files written, %d conflicts detected", len(written), conflicts)
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every file which was reported as written must be intact
+		r, err := filestream.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read := map[string]bool{}
+		for r.Next() {
+			path := r.File().Path()
+			dat, err := ioutil.ReadAll(r.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(dat) != path {
+				t.Errorf("file %q has corrupted contents %q", path, dat)
+			}
+			read[path] = true
+		}
+		if r.Err() != nil {
+			t.Fatal(r.Err())
+		}
+		if diff := cmp.Diff(written, read); diff != "" {
+			t.Errorf("unexpected files (-written +read):\n%s", diff)
+		}
+	})
+}
+
+func TestCallbackUsesWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var w *filestream.Writer
+	var flushes int
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{
+		FileDone: func(path string, bytesWritten int64) {
+			// the callback runs after the operation, so it does not conflict with it
+			err := w.Flush()
+			if err != nil {
+				t.Errorf("failed to flush from callback: %v", err)
+			}
+			flushes++
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("hello.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushes != 1 {
+		t.Errorf("expected 1 flush but got %d", flushes)
+	}
+}
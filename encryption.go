@@ -0,0 +1,342 @@
+package filestream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encryption is the configuration of stream encryption.
+// Exactly one of Key and Passphrase must be set.
+type Encryption struct {
+	// Key is a 256-bit AES key.
+	Key []byte
+
+	// Passphrase is a passphrase from which the key is derived with PBKDF2-HMAC-SHA256.
+	// A random salt is generated for each stream and stored in the stream header.
+	Passphrase string
+}
+
+// ErrWrongKey indicates that the key used to read an encrypted stream does not match the key it was written with.
+var ErrWrongKey = errors.New("wrong encryption key")
+
+// ErrAuthentication indicates that encrypted data failed authentication, and has been corrupted or tampered with.
+var ErrAuthentication = errors.New("encrypted data failed authentication")
+
+const (
+	// encryptionAlgorithm is the only supported encryption algorithm.
+	encryptionAlgorithm = "aes-256-gcm"
+
+	// pbkdf2Iterations is the number of PBKDF2 iterations used to derive keys from passphrases.
+	pbkdf2Iterations = 100000
+
+	// maxPBKDF2Iterations is the largest number of PBKDF2 iterations which will be accepted from a stream header.
+	maxPBKDF2Iterations = 1 << 24
+
+	// encryptedSegmentSize is the maximum amount of plaintext in an encrypted segment.
+	encryptedSegmentSize = 64 * 1024
+
+	// finalSegment is the bit of a segment length which marks the last segment of the stream.
+	finalSegment = 1 << 31
+
+	// keyCheckCounter is a segment counter reserved for the key check tag.
+	keyCheckCounter = 1<<32 - 1
+)
+
+// newEncryption generates the encryption header for a new stream and sets up the cipher.
+func newEncryption(cfg *Encryption) (*encryptionHeader, cipher.AEAD, error) {
+	hdr := &encryptionHeader{
+		Algorithm: encryptionAlgorithm,
+		Nonce:     make([]byte, 8),
+	}
+	_, err := io.ReadFull(rand.Reader, hdr.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key []byte
+	switch {
+	case cfg.Key != nil && cfg.Passphrase != "":
+		return nil, nil, errors.New("encryption key and passphrase are mutually exclusive")
+	case cfg.Passphrase != "":
+		hdr.Salt = make([]byte, 16)
+		_, err = io.ReadFull(rand.Reader, hdr.Salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		hdr.Iterations = pbkdf2Iterations
+		key = pbkdf2([]byte(cfg.Passphrase), hdr.Salt, hdr.Iterations, 32)
+	default:
+		key = cfg.Key
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr.KeyCheck = keyCheck(aead, hdr.Nonce)
+
+	return hdr, aead, nil
+}
+
+// openEncryption sets up the cipher to decrypt a stream, and verifies that the key matches.
+func openEncryption(cfg *Encryption, hdr *encryptionHeader) (cipher.AEAD, error) {
+	if cfg == nil {
+		return nil, errors.New("stream is encrypted but no key was provided")
+	}
+	if hdr.Algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", hdr.Algorithm)
+	}
+	if len(hdr.Nonce) != 8 {
+		return nil, errors.New("invalid encryption nonce")
+	}
+
+	var key []byte
+	if hdr.Salt != nil {
+		if cfg.Passphrase == "" {
+			return nil, errors.New("stream is encrypted with a passphrase but no passphrase was provided")
+		}
+		if hdr.Iterations <= 0 || hdr.Iterations > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("invalid PBKDF2 iteration count %d", hdr.Iterations)
+		}
+		key = pbkdf2([]byte(cfg.Passphrase), hdr.Salt, hdr.Iterations, 32)
+	} else {
+		if cfg.Key == nil {
+			return nil, errors.New("stream is encrypted with a key but no key was provided")
+		}
+		key = cfg.Key
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(keyCheck(aead, hdr.Nonce), hdr.KeyCheck) != 1 {
+		return nil, ErrWrongKey
+	}
+
+	return aead, nil
+}
+
+// newAEAD sets up AES-256-GCM with a key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyCheck computes a tag which can be used to check that a reader has the correct key.
+// This is the authentication tag of an empty segment under a reserved nonce.
+func keyCheck(aead cipher.AEAD, prefix []byte) []byte {
+	return aead.Seal(nil, segmentNonce(prefix, keyCheckCounter), nil, []byte("filestream key check"))
+}
+
+// segmentNonce computes the nonce of a segment from the nonce prefix and the segment counter.
+func segmentNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+// pbkdf2 derives a key from a password using PBKDF2 with HMAC-SHA256, as specified in RFC 8018.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var idx [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		// U_1 = PRF(password, salt || INT(block))
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(idx[:], uint32(block))
+		prf.Write(idx[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		// T = U_1 ^ U_2 ^ ... ^ U_iter
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
+
+// encryptWriter encrypts data into a sequence of authenticated segments.
+// Each segment is a 4-byte big-endian ciphertext length followed by the ciphertext.
+// The high bit of the length is set on the final segment, so that truncation of the stream can be detected.
+// The length is authenticated as additional data, and the nonce includes the index of the segment, so segments cannot be reordered.
+type encryptWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+}
+
+func newEncryptWriter(dst io.Writer, aead cipher.AEAD, prefix []byte) *encryptWriter {
+	return &encryptWriter{
+		dst:    dst,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptedSegmentSize),
+	}
+}
+
+func (ew *encryptWriter) Write(dat []byte) (int, error) {
+	var n int
+	for len(dat) > 0 {
+		// only seal a full segment once more data arrives, so that the final segment is never empty unless the stream is
+		if len(ew.buf) == cap(ew.buf) {
+			err := ew.seal(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], dat)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		dat = dat[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+// seal encrypts the buffered plaintext as a segment and writes it out.
+func (ew *encryptWriter) seal(final bool) error {
+	if ew.counter == keyCheckCounter {
+		return errors.New("too much data to encrypt in one stream")
+	}
+
+	var hdr [4]byte
+	l := uint32(len(ew.buf) + ew.aead.Overhead())
+	if final {
+		l |= finalSegment
+	}
+	binary.BigEndian.PutUint32(hdr[:], l)
+
+	ew.out = ew.aead.Seal(append(ew.out[:0], hdr[:]...), segmentNonce(ew.prefix, ew.counter), ew.buf, hdr[:])
+	ew.counter++
+	ew.buf = ew.buf[:0]
+
+	_, err := ew.dst.Write(ew.out)
+	return err
+}
+
+// Flush encrypts and writes out any buffered data as a segment.
+func (ew *encryptWriter) Flush() error {
+	if len(ew.buf) == 0 {
+		return nil
+	}
+	return ew.seal(false)
+}
+
+// Close writes the final segment.
+// It does not close the destination.
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+// decryptReader decrypts a sequence of segments written by an encryptWriter.
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+func newDecryptReader(src io.Reader, aead cipher.AEAD, prefix []byte) *decryptReader {
+	return &decryptReader{
+		src:    src,
+		aead:   aead,
+		prefix: prefix,
+	}
+}
+
+func (dr *decryptReader) Read(dat []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		err := dr.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(dat, dr.plain)
+	dr.plain = dr.plain[n:]
+
+	return n, nil
+}
+
+// open reads and decrypts the next segment.
+func (dr *decryptReader) open() error {
+	var hdr [4]byte
+	_, err := io.ReadFull(dr.src, hdr[:])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	final := l&finalSegment != 0
+	l &^= finalSegment
+	if l < uint32(dr.aead.Overhead()) || l > uint32(encryptedSegmentSize+dr.aead.Overhead()) {
+		return ErrAuthentication
+	}
+	if dr.counter == keyCheckCounter {
+		return ErrAuthentication
+	}
+
+	if dr.buf == nil {
+		dr.buf = make([]byte, encryptedSegmentSize+dr.aead.Overhead())
+	}
+	ct := dr.buf[:l]
+	_, err = io.ReadFull(dr.src, ct)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plain, err := dr.aead.Open(ct[:0], segmentNonce(dr.prefix, dr.counter), ct, hdr[:])
+	if err != nil {
+		return ErrAuthentication
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.done = final
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+// encryptFiles writes a stream of files with the given options.
+func encryptFiles(t *testing.T, opts filestream.StreamOptions, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		fw, err := w.File(path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// decryptFiles reads a stream of files with the given options.
+func decryptFiles(dat []byte, opts filestream.ReaderOptions) (map[string]string, error) {
+	r, err := filestream.NewReaderWithOptions(bytes.NewReader(dat), opts)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for r.Next() {
+		f := r.File()
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		files[f.Path()] = string(body)
+	}
+	return files, r.Err()
+}
+
+func TestEncryption(t *testing.T) {
+	files := map[string]string{
+		"secret.txt": "the secret plans",
+		"big.bin":    string(bytes.Repeat([]byte("0123456789abcdef"), 20000)),
+	}
+	key := bytes.Repeat([]byte{0x42}, 32)
+	wrongKey := bytes.Repeat([]byte{0x24}, 32)
+
+	tests := []struct {
+		Name        string
+		Compression string
+		Enc, Wrong  filestream.Encryption
+	}{
+		{"Key", "", filestream.Encryption{Key: key}, filestream.Encryption{Key: wrongKey}},
+		{"KeyGzip", "gzip", filestream.Encryption{Key: key}, filestream.Encryption{Key: wrongKey}},
+		{"PassphraseLZ4", "lz4", filestream.Encryption{Passphrase: "hunter2"}, filestream.Encryption{Passphrase: "hunter3"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dat := encryptFiles(t, filestream.StreamOptions{
+				Compression: tc.Compression,
+				Encryption:  &tc.Enc,
+			}, files)
+			if bytes.Contains(dat, []byte("secret")) {
+				t.Error("plaintext found in encrypted stream")
+			}
+
+			got, err := decryptFiles(dat, filestream.ReaderOptions{Encryption: &tc.Enc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(files) {
+				t.Errorf("expected %d files but got %d", len(files), len(got))
+			}
+			for path, data := range files {
+				if got[path] != data {
+					t.Errorf("file %q does not match", path)
+				}
+			}
+
+			_, err = decryptFiles(dat, filestream.ReaderOptions{Encryption: &tc.Wrong})
+			if !errors.Is(err, filestream.ErrWrongKey) {
+				t.Errorf("expected wrong key error but got %v", err)
+			}
+
+			_, err = decryptFiles(dat, filestream.ReaderOptions{})
+			if err == nil {
+				t.Error("read encrypted stream without a key")
+			}
+		})
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	enc := filestream.Encryption{Key: bytes.Repeat([]byte{0x42}, 32)}
+	dat := encryptFiles(t, filestream.StreamOptions{Encryption: &enc}, map[string]string{
+		"secret.txt": "the secret plans",
+	})
+	hdrLen := bytes.IndexByte(dat, 0) + 1
+
+	// flip a bit in the ciphertext
+	tampered := append([]byte(nil), dat...)
+	tampered[len(tampered)-1] ^= 1
+	_, err := decryptFiles(tampered, filestream.ReaderOptions{Encryption: &enc})
+	if !errors.Is(err, filestream.ErrAuthentication) {
+		t.Errorf("expected authentication error but got %v", err)
+	}
+
+	// truncate the stream
+	_, err = decryptFiles(dat[:hdrLen], filestream.ReaderOptions{Encryption: &enc})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF but got %v", err)
+	}
+}
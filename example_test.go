@@ -23,15 +23,7 @@ func Example_minimal() {
 		{"smile.txt", "☺"},
 	}
 	for _, file := range files {
-		fw, err := w.File(file.Name, filestream.FileOptions{})
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = fw.Write([]byte(file.Body))
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = fw.Close()
+		err = w.WriteFile(file.Name, []byte(file.Body), filestream.FileOptions{})
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -63,3 +55,22 @@ func Example_minimal() {
 	// File "hello.txt": Hello World!
 	// File "smile.txt": ☺
 }
+
+func ExampleEncodeToBytes() {
+	dat, err := filestream.EncodeToBytes(map[string][]byte{
+		"hello.txt": []byte("Hello World!"),
+		"smile.txt": []byte("☺"),
+	}, filestream.StreamOptions{Compression: "gzip"})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files, err := filestream.DecodeToMap(dat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %s\n", files["hello.txt"], files["smile.txt"])
+
+	// Output:
+	// Hello World! ☺
+}
@@ -0,0 +1,57 @@
+package filestream
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Extract scans a stream for the entry at the given path, and returns a reader over its body along with its options.
+// The bodies of the entries before it are skipped without being returned.
+// If the stream contains multiple entries with the path, the first is returned.
+// If there is no such entry, the error satisfies errors.Is(err, os.ErrNotExist).
+// Closing the returned reader releases the decompressor of the stream (if any) without reading the rest of the stream.
+// The Reader buffers ahead of the data it has used, so the position of src afterwards is undefined.
+func Extract(src io.Reader, path string) (io.ReadCloser, FileOptions, error) {
+	r, err := NewReader(src)
+	if err != nil {
+		return nil, FileOptions{}, err
+	}
+	r.Filter(func(fh *FileHeader) bool {
+		return fh.Path() == path
+	})
+	if !r.Next() {
+		if r.Err() != nil {
+			return nil, FileOptions{}, r.Err()
+		}
+		return nil, FileOptions{}, &os.PathError{Op: "extract", Path: path, Err: os.ErrNotExist}
+	}
+
+	return &extractReader{r: r, fr: r.File()}, r.File().Opts(), nil
+}
+
+// extractReader reads the body of a file extracted from a stream.
+type extractReader struct {
+	r      *Reader
+	fr     *FileReader
+	closed bool
+}
+
+func (er *extractReader) Read(dat []byte) (int, error) {
+	if er.closed {
+		return 0, errors.New("read from closed file")
+	}
+	return er.fr.Read(dat)
+}
+
+func (er *extractReader) Close() error {
+	if er.closed {
+		return errors.New("file already closed")
+	}
+	er.closed = true
+
+	if er.r.closer != nil {
+		return er.r.closer.Close()
+	}
+	return nil
+}
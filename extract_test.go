@@ -0,0 +1,69 @@
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestExtract(t *testing.T) {
+	for _, compression := range []string{"", "gzip"} {
+		compression := compression
+		t.Run("Compression="+compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: compression, Checksums: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("first.txt", bytes.Repeat([]byte("first"), 1000), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("second.txt", []byte("the second file"), filestream.FileOptions{Permissions: 0640, ExactPermissions: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile("third.txt", []byte("the third file"), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dat := buf.Bytes()
+
+			rc, opts, err := filestream.Extract(bytes.NewReader(dat), "second.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "the second file" {
+				t.Errorf("expected %q but got %q", "the second file", got)
+			}
+			if opts.Permissions != 0640 {
+				t.Errorf("expected permissions 0640 but got %v", opts.Permissions)
+			}
+			err = rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = rc.Read(make([]byte, 1))
+			if err == nil {
+				t.Error("read from closed file")
+			}
+
+			_, _, err = filestream.Extract(bytes.NewReader(dat), "missing.txt")
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected os.ErrNotExist but got %v", err)
+			}
+		})
+	}
+}
@@ -1,11 +1,22 @@
 package filestream
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // EncodeOptions are a set of options for encoding files from the filesystem into a filestream.
@@ -33,31 +44,434 @@ type EncodeOptions struct {
 	// Failed group name lookups will result in errors.
 	// This is supported on Linux and Darwin, and may be a no-op on other systems.
 	IncludeGroup bool
+
+	// IncludeXattrs is whether or not to include the extended attributes of files in the stream.
+	// This is supported on Linux and macOS, and is a no-op on other systems.
+	IncludeXattrs bool
+
+	// DetectHardlinks is whether or not to detect files which are hard linked together.
+	// Setting this to true will cause additional links to an already-encoded file to be sent as hard link entries, rather than sending the data again.
+	// This is supported on Linux and Darwin, and is a no-op on other systems.
+	DetectHardlinks bool
+
+	// DetectSparse is whether to detect runs of zero bytes in files, and encode them as holes rather than sending the zeros.
+	// Zero runs are detected in blocks of 4 KiB, so holes in sparse files (such as disk images) are encoded compactly.
+	// This requires the stream to be created with StreamOptions.Sparse.
+	DetectSparse bool
+
+	// DetectContentType is whether to record the MIME type of each regular file in the stream.
+	// The type is detected from the first 512 bytes of the file using http.DetectContentType, and can be read back with FileReader.ContentType.
+	// EstimateSize does not account for the detected types.
+	DetectContentType bool
+
+	// CompressionSelector is an optional callback to choose the compression algorithm for the body of each regular file.
+	// It is called with the path of the file within the stream and the file info, and returns the name of the algorithm, or an empty string to store the file uncompressed.
+	// This allows already-compressed files (such as media or archives) to be stored as they are, while other files are compressed.
+	// This requires the stream to be created with StreamOptions.PerFileCompression, and should not be combined with stream-level compression.
+	// Holes are not detected in compressed files, and EstimateSize does not account for compression.
+	CompressionSelector func(path string, info os.FileInfo) string
+
+	// SkipIncompressible is whether to store files uncompressed if a sample of the file does not compress well.
+	// Before a file selected for compression is encoded, the start of it is compressed, and the file is stored if the compressed sample is larger than CompressionThreshold times the size of the sample.
+	// The decision is recorded in the file header, as if CompressionSelector had returned an empty string.
+	// Empty files are always stored.
+	SkipIncompressible bool
+
+	// CompressionSampleSize is the number of bytes at the start of each file which are sampled by SkipIncompressible.
+	// Defaults to 64 KiB.
+	CompressionSampleSize int
+
+	// CompressionThreshold is the largest ratio of compressed to uncompressed size of the sample for which SkipIncompressible still compresses a file.
+	// Defaults to 0.9, so that a file is only compressed if the sample shrinks by at least 10%.
+	CompressionThreshold float64
+
+	// Deterministic is whether to encode the files such that the same tree produces byte-identical output on any machine.
+	// Entries are always encoded in lexical order, as the directory walk sorts the entries of each directory.
+	// In deterministic mode, permissions (if included) are normalized to 0755 for directories and executable files and 0644 for other files.
+	// The owning user and group are only encoded if explicitly requested with IncludeUser and IncludeGroup.
+	Deterministic bool
+
+	// Exclude is a list of glob patterns of paths to skip.
+	// Patterns use path.Match syntax, and are matched against the slash-separated path of each entry within the stream.
+	// Patterns without a slash are matched against the last element of the path, so "*.tmp" matches temporary files in any directory.
+	// Excluding a directory skips everything within it.
+	Exclude []string
+
+	// Include is a list of glob patterns of files to encode, using the same syntax as Exclude.
+	// If this is not empty, only files and links matching a pattern are encoded.
+	// Directories are always traversed, and Exclude takes precedence over Include.
+	Include []string
+
+	// Filter is an optional callback to select which entries to encode.
+	// It is called with the path of each entry within the stream (relative to Base, as it will be encoded) and the file info.
+	// If it returns false, the entry is skipped, along with everything within it if it is a directory.
+	// It is only called for entries which pass the Exclude and Include patterns.
+	Filter func(path string, info os.FileInfo) bool
+
+	// Rewrite is an optional callback to change the path which each entry is stored under.
+	// It is called with the path of each entry relative to Base (after the Exclude, Include, and Filter checks, which use the original path) and the file info, and returns the path to store.
+	// If it returns false, the entry is skipped, along with everything within it if it is a directory.
+	// This may be used to add a prefix to every path, for example.
+	// Hard link entries refer to their targets by the rewritten path.
+	Rewrite func(relPath string, info os.FileInfo) (string, bool)
+
+	// FollowSymlinks is whether to encode the targets of symbolic links as if they were at the location of the link.
+	// Symbolic links to directories are followed, so everything within the target directory is encoded under the path of the link.
+	// A directory which has already been encoded is skipped if it is reached again through a link, which prevents cycles.
+	// If this is not set, symbolic links are not supported, and encoding fails if one is found.
+	FollowSymlinks bool
+}
+
+// fileID is the identity of a file on the filesystem.
+type fileID struct {
+	dev, ino uint64
+}
+
+// dirSet is a set of directories which have been visited.
+type dirSet struct {
+	ids map[fileID]bool
+
+	// infos holds directories without a fileID, which are compared with os.SameFile
+	infos []os.FileInfo
+}
+
+// add adds a directory to the set, returning false if it was already present.
+func (s *dirSet) add(info os.FileInfo) bool {
+	if id, ok := getInode(info); ok {
+		if s.ids[id] {
+			return false
+		}
+		if s.ids == nil {
+			s.ids = map[fileID]bool{}
+		}
+		s.ids[id] = true
+		return true
+	}
+	for _, v := range s.infos {
+		if os.SameFile(v, info) {
+			return false
+		}
+	}
+	s.infos = append(s.infos, info)
+	return true
 }
 
 // EncodeFiles encodes files from a path into a stream.
+// Progress within each file is reported through the StreamOptions.Progress callback of dst.
 func EncodeFiles(dst *Writer, path string, opts EncodeOptions) error {
+	return EncodeFilesContext(context.Background(), dst, path, opts)
+}
+
+// EncodeFilesContext encodes files from a path into a stream, stopping early if the context is cancelled.
+// If the context is cancelled while a file is being streamed, the file is left incomplete.
+// The stream cannot be completed after this, and closing dst will return ErrWriteInterrupted rather than terminating the stream.
+func EncodeFilesContext(ctx context.Context, dst *Writer, path string, opts EncodeOptions) error {
+	return encodeFiles(ctx, dst, []string{path}, opts)
+}
+
+// EncodeFilesMulti encodes files from multiple paths into a stream, in order.
+// All of the paths are encoded relative to the same base, as with tar.
+// If opts.Base is not set, it defaults to the deepest directory containing all of the paths, so that each path is encoded under its own name.
+// Entries which are reached from more than one of the paths (such as when one path is within another) are only encoded once.
+func EncodeFilesMulti(dst *Writer, paths []string, opts EncodeOptions) error {
+	if len(paths) == 0 {
+		return errors.New("no paths to encode")
+	}
+	if opts.Base == "" {
+		base, err := commonDir(paths)
+		if err != nil {
+			return err
+		}
+		opts.Base = base
+	}
+
+	return encodeFiles(context.Background(), dst, paths, opts)
+}
+
+// commonDir finds the deepest directory which contains all of the paths.
+func commonDir(paths []string) (string, error) {
+	var dir string
+	for i, p := range paths {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		if i == 0 {
+			dir = filepath.Dir(p)
+			continue
+		}
+		for {
+			rel, err := filepath.Rel(dir, p)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir, nil
+}
+
+// encodeFiles encodes files from each of the paths into a stream.
+func encodeFiles(ctx context.Context, dst *Writer, paths []string, opts EncodeOptions) error {
+	if opts.DetectSparse && !dst.sparse {
+		return errors.New("sparse detection requires StreamOptions.Sparse")
+	}
+	if opts.CompressionSelector != nil && !dst.perFile {
+		return errors.New("compression selection requires StreamOptions.PerFileCompression")
+	}
+
+	return walkFiles(ctx, paths, opts, func(rawpath string, info os.FileInfo, hdr fileHeader) error {
+		if !info.Mode().IsRegular() || hdr.HardlinkTo != "" {
+			// encode entry without a body
+			fw, err := dst.startEntry(hdr)
+			if err != nil {
+				return err
+			}
+			return fw.Close()
+		}
+
+		// open file
+		f, err := os.Open(rawpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var src io.Reader = ctxReader{ctx, f}
+
+		// sniff the content type, and put the sniffed data back in front of the rest of the file
+		if opts.DetectContentType {
+			head := make([]byte, 512)
+			n, err := io.ReadFull(src, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			head = head[:n]
+			hdr.ContentType = http.DetectContentType(head)
+			src = io.MultiReader(bytes.NewReader(head), src)
+		}
+
+		// choose the compression of the body
+		if opts.CompressionSelector != nil {
+			hdr.Compression = opts.CompressionSelector(hdr.Path, info)
+		}
+		if hdr.Compression != "" && opts.SkipIncompressible {
+			size := opts.CompressionSampleSize
+			if size <= 0 {
+				size = 64 << 10
+			}
+			threshold := opts.CompressionThreshold
+			if threshold <= 0 {
+				threshold = 0.9
+			}
+
+			// sample the file, and put the sampled data back in front of the rest of the file
+			sample := make([]byte, size)
+			n, err := io.ReadFull(src, sample)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			sample = sample[:n]
+			src = io.MultiReader(bytes.NewReader(sample), src)
+
+			ratio, err := compressionRatio(hdr.Compression, sample)
+			if err != nil {
+				return err
+			}
+			if n == 0 || ratio > threshold {
+				hdr.Compression = ""
+			}
+		}
+
+		// open file entry stream
+		fw, err := dst.startEntry(hdr)
+		if err != nil {
+			return err
+		}
+
+		// copy file data to stream
+		if opts.DetectSparse && hdr.Compression == "" {
+			buf := copyBuffers.Get().(*[]byte)
+			err = sparseCopy(fw, src, *buf)
+			copyBuffers.Put(buf)
+		} else {
+			_, err = fw.ReadFrom(src)
+		}
+		if err != nil {
+			return err
+		}
+
+		// close file
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+
+		// terminate file stream entry
+		err = fw.Close()
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// compressionRatio compresses a sample of data with the given algorithm, and returns the ratio of the compressed size to the original size.
+func compressionRatio(algo string, sample []byte) (float64, error) {
+	if len(sample) == 0 {
+		return 1, nil
+	}
+
+	cw := &countingWriter{w: ioutil.Discard}
+	z, err := compress(algo, 0, nil, cw)
+	if err != nil {
+		return 0, err
+	}
+	_, err = z.Write(sample)
+	if err != nil {
+		return 0, err
+	}
+	err = z.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(cw.n) / float64(len(sample)), nil
+}
+
+// checkPatterns checks that a list of glob patterns are valid.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchAny checks whether a slash-separated path matches any of the patterns.
+// Patterns without a slash are matched against the last element of the path.
+// The patterns must have already been validated.
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// specialPermissions are the setuid, setgid, and sticky bits.
+const specialPermissions = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// normalizePermissions normalizes the permissions of a file for deterministic encoding.
+func normalizePermissions(mode os.FileMode) os.FileMode {
+	if mode.IsDir() || mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// copyBufferSize is the size of the buffer used to copy file data into a stream.
+// Each read into the buffer is sent as a single chunk.
+const copyBufferSize = 32 * 1024
+
+// copyBuffers pools buffers of copyBufferSize bytes.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// walkFiles walks the files under each of the paths in order, calling fn with the header of each entry to encode.
+// Entries which are reached from more than one of the paths are only encoded once.
+func walkFiles(ctx context.Context, paths []string, opts EncodeOptions, fn func(rawpath string, info os.FileInfo, hdr fileHeader) error) error {
 	// fix paths to be appropriate and absolute
 	if opts.Base == "" {
-		opts.Base = path
+		opts.Base = paths[0]
+	}
+	var err error
+	opts.Base, err = filepath.Abs(opts.Base)
+	if err != nil {
+		return err
 	}
-	path, err := filepath.Abs(path)
+
+	// check patterns
+	err = checkPatterns(opts.Exclude)
 	if err != nil {
 		return err
 	}
-	opts.Base, err = filepath.Abs(opts.Base)
+	err = checkPatterns(opts.Include)
 	if err != nil {
 		return err
 	}
 
-	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+	// links tracks the stream paths of multiply-linked files
+	links := map[fileID]string{}
+
+	// seen tracks the stream paths which have been encoded, if the paths may overlap
+	var seen map[string]bool
+	if len(paths) > 1 {
+		seen = map[string]bool{}
+	}
+
+	// dirs tracks the directories which have been walked, if symbolic links are followed
+	var dirs dirSet
+
+	// visit handles a file at rawpath, which is encoded as if it were at path
+	var visit func(rawpath, path string, info os.FileInfo, err error) error
+	visit = func(rawpath, path string, info os.FileInfo, err error) error {
 		// dont try to handle inaccessible files
 		if err != nil {
 			return err
 		}
 
+		// stop if cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if opts.FollowSymlinks {
+			if info.Mode()&os.ModeSymlink != 0 {
+				// load the target of the link
+				info, err = os.Stat(rawpath)
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					// walk the target directory in place of the link
+					target, err := filepath.EvalSymlinks(rawpath)
+					if err != nil {
+						return err
+					}
+					link := path
+					return filepath.Walk(target, func(rawpath string, info os.FileInfo, err error) error {
+						rel, rerr := filepath.Rel(target, rawpath)
+						if rerr != nil {
+							return rerr
+						}
+						return visit(rawpath, filepath.Join(link, rel), info, err)
+					})
+				}
+			}
+
+			// skip directories which were already walked through another link
+			if info.IsDir() && !dirs.add(info) {
+				return filepath.SkipDir
+			}
+		}
+
 		// convert paths to relative when appropriate
-		rawpath := path
 		if opts.Base != "/" {
 			path, err = filepath.Rel(opts.Base, path)
 			if err != nil {
@@ -65,10 +479,57 @@ func EncodeFiles(dst *Writer, path string, opts EncodeOptions) error {
 			}
 		}
 
+		// "/" is the separator within the stream
+		path = filepath.ToSlash(path)
+
+		// apply filters
+		if matchAny(opts.Exclude, filepath.ToSlash(path)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(opts.Include) > 0 && !info.IsDir() && !matchAny(opts.Include, filepath.ToSlash(path)) {
+			return nil
+		}
+		if opts.Filter != nil && !opts.Filter(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// change the stored path
+		if opts.Rewrite != nil {
+			var ok bool
+			path, ok = opts.Rewrite(path, info)
+			if !ok {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		// skip entries which were already encoded under a previous path, including everything within a directory
+		if seen != nil {
+			if seen[path] {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			seen[path] = true
+		}
+
 		// load appropriate file options
 		var fo FileOptions
 		if opts.IncludePermissions {
+			fo.ExactPermissions = true
 			fo.Permissions = info.Mode()
+			if opts.Deterministic {
+				fo.Permissions = normalizePermissions(info.Mode())
+			}
 		}
 		if opts.IncludeUser {
 			fo.User, err = getUser(info)
@@ -82,49 +543,120 @@ func EncodeFiles(dst *Writer, path string, opts EncodeOptions) error {
 				return err
 			}
 		}
+		if opts.IncludeXattrs {
+			fo.Xattrs, err = getXattrs(rawpath)
+			if err != nil {
+				return err
+			}
+		}
+		hdr := fo.header(path)
 
 		switch {
 		case info.Mode().IsDir():
 			// encode directory
-			return dst.Directory(path, fo)
+			hdr.Mode |= os.ModeDir
 		case info.Mode().IsRegular():
-			// open file entry stream
-			fw, err := dst.File(path, fo)
-			if err != nil {
-				return err
+			// encode additional links to a file as hard links
+			if opts.DetectHardlinks {
+				if id, ok := getFileID(info); ok {
+					if target, ok := links[id]; ok {
+						hdr.HardlinkTo = target
+						break
+					}
+					links[id] = path
+				}
 			}
 
-			// open file
-			f, err := os.Open(rawpath)
-			if err != nil {
-				return err
+			size := info.Size()
+			hdr.Size = &size
+		case info.Mode()&os.ModeSocket != 0:
+			return fmt.Errorf("sockets are not supported: %s", rawpath)
+		case info.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0:
+			// encode FIFOs and devices without a body
+			hdr.Mode |= info.Mode() & (os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice)
+			if info.Mode()&os.ModeDevice != 0 {
+				var ok bool
+				hdr.Major, hdr.Minor, ok = getDevice(info)
+				if !ok {
+					return fmt.Errorf("device files are not supported on this platform: %s", rawpath)
+				}
 			}
-			defer f.Close()
+		default:
+			// error if we dont know what to do with a special file
+			return fmt.Errorf("unsupported special file: %s", rawpath)
+		}
 
-			// copy file data to stream
-			_, err = io.Copy(fw, f)
-			if err != nil {
-				return err
-			}
+		return fn(rawpath, info, hdr)
+	}
 
-			// close file
-			err = f.Close()
-			if err != nil {
-				return err
-			}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			return visit(path, path, info, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// terminate file stream entry
-			err = fw.Close()
-			if err != nil {
-				return err
-			}
+// EstimateSize calculates the size of the stream which EncodeFiles would produce for the given path.
+// This assumes a stream created with default StreamOptions, and is exact unless the files are modified in the meantime.
+// The size of a compressed stream can only be estimated from this.
+func EstimateSize(path string, opts EncodeOptions) (int64, error) {
+	// stream header and terminator
+	size, err := encodedSize(streamHeader{})
+	if err != nil {
+		return 0, err
+	}
+	tsize, err := encodedSize(fileHeader{Path: "\x00"})
+	if err != nil {
+		return 0, err
+	}
+	size += tsize
 
-			return nil
-		default:
-			// error if we dont know what to do with a special file
-			return fmt.Errorf("unsupported special file: %s", rawpath)
+	err = walkFiles(context.Background(), []string{path}, opts, func(rawpath string, info os.FileInfo, hdr fileHeader) error {
+		// file header
+		hsize, err := encodedSize(hdr)
+		if err != nil {
+			return err
+		}
+		size += hsize
+
+		// body chunks
+		if info.Mode().IsRegular() && hdr.HardlinkTo == "" {
+			full, rem := *hdr.Size/copyBufferSize, *hdr.Size%copyBufferSize
+			size += full * (int64(len(strconv.Itoa(copyBufferSize))) + 1 + copyBufferSize)
+			if rem > 0 {
+				size += int64(len(strconv.FormatInt(rem, 10))) + 1 + rem
+			}
 		}
+
+		// body terminator
+		size += int64(len("0\x00"))
+
+		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// encodedSize returns the encoded size of a header, including the null terminator.
+func encodedSize(hdr interface{}) (int64, error) {
+	dat, err := json.Marshal(hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	// the encoder adds a newline, and the header is terminated by a null
+	return int64(len(dat)) + 2, nil
 }
 
 // DecodeOptions is a set of options for decoding files from a stream into the filesystem.
@@ -133,6 +665,7 @@ type DecodeOptions struct {
 	Base string
 
 	// PreservePermissions is whether or not to preserve the perimission codes from the stream.
+	// This includes the setuid, setgid, and sticky bits, which are otherwise cleared.
 	PreservePermissions bool
 
 	// PreserveUser is whether or not to preserve the owning user info from the stream.
@@ -141,18 +674,153 @@ type DecodeOptions struct {
 	// PreserveGroup is whether or not to preserve the owning group info from the stream.
 	PreserveGroup bool
 
+	// CreateDevices is whether or not to create device nodes from the stream.
+	// This typically requires root privileges.
+	// If this is not set, device nodes are skipped.
+	// FIFOs are always created.
+	CreateDevices bool
+
+	// PreserveXattrs is whether or not to restore extended attributes from the stream.
+	// This is supported on Linux and macOS, and is a no-op on other systems.
+	PreserveXattrs bool
+
 	// DefaultOpts are the default file options.
 	// If any given option is not being preserved, the corresponding default will be applied to everything.
 	// If any given option is being preserved, the corresponding default will be applied where not present in the stream.
 	// Defaults to 640, current user, current group.
 	DefaultOpts FileOptions
+
+	// DefaultDirOpts are the default options for directories, which are applied in the same way as DefaultOpts.
+	// If the permissions are unset, they default to the permissions of DefaultOpts with the owner execute bit added.
+	DefaultDirOpts FileOptions
+
+	// ApplyUmask is whether to mask the default permissions with the umask of the process, as tar does.
+	// This only affects permissions taken from DefaultOpts or DefaultDirOpts, and not permissions preserved from the stream.
+	// Note that files are still created through the operating system, which may apply the umask to preserved permissions as well.
+	// The masked permissions are the ones reported to OnEntry, and used in a dry run.
+	// The umask is read once at the start of decoding, and is always 0 on platforms without one.
+	ApplyUmask bool
+
+	// AllowAbsolute is whether to allow absolute paths in the stream.
+	// If this is set, absolute paths are decoded to their absolute location, rather than relative to Base.
+	// Otherwise, absolute paths are rejected with ErrPathEscape.
+	AllowAbsolute bool
+
+	// StripAbsolute is whether to strip the leading slash (and volume name) from absolute paths in the stream, as tar does.
+	// If this is set, absolute paths are decoded relative to Base, so a stream encoded with EncodeOptions.Base set to "/" can be extracted elsewhere.
+	// This takes precedence over AllowAbsolute, and also applies to hard link targets.
+	StripAbsolute bool
+
+	// StripComponents is the number of leading path components to remove from each entry, as with tar --strip-components.
+	// Entries (and hard links to targets) with no more than this many components are skipped.
+	// Leading slashes are removed along with the components, so the remaining paths are relative to Base.
+	StripComponents int
+
+	// Rewrite is an optional callback to relocate or rename entries as they are decoded.
+	// It is called with the path of each entry in the stream (after StripComponents is applied), and returns the path to decode the entry to, which is then resolved against Base and checked in the same way as paths from the stream.
+	// If it returns false, the entry is skipped.
+	// Hard link targets are rewritten in the same way, and links whose targets are skipped are skipped as well.
+	Rewrite func(path string) (string, bool)
+
+	// MaxFileSize is the maximum size of the body of a single file.
+	// Files which are larger fail with ErrFileTooLarge.
+	// Zero means unlimited.
+	MaxFileSize int64
+
+	// MaxTotalSize is the maximum total size of the bodies of all files.
+	// If the total is exceeded, decoding fails with ErrTotalTooLarge.
+	// Zero means unlimited.
+	MaxTotalSize int64
+
+	// MaxFiles is the maximum number of entries in the stream, including directories and links.
+	// If there are more entries, decoding fails with ErrTooManyFiles.
+	// Zero means unlimited.
+	MaxFiles int
+
+	// MaxPathLength is the maximum length of a path in the stream, in bytes.
+	// Longer paths fail with ErrPathTooLong.
+	// Zero means unlimited.
+	MaxPathLength int
+
+	// MaxChunkSize is the largest chunk length which may be declared in the body of a file, as with ReaderOptions.MaxChunkSize.
+	// Longer chunks fail with ErrChunkTooLarge.
+	// This only lowers the limit of the Reader while decoding, and zero leaves it unchanged.
+	MaxChunkSize int64
+
+	// DryRun is whether to read and validate the stream without modifying the filesystem.
+	// File bodies are still read in full, so that errors in the stream are detected.
+	DryRun bool
+
+	// OnEntry is an optional callback which is invoked after each entry is decoded, or would have been decoded in a dry run.
+	// It is called with the path on the filesystem, the options which are applied to it, and the size of the body.
+	OnEntry func(path string, opts FileOptions, size int64)
+
+	// Overwrite is how to handle files which already exist.
+	// Defaults to OverwriteTruncate.
+	Overwrite OverwriteMode
+
+	// NoFollowSymlinks is whether to refuse to decode through symbolic links which already exist in the destination.
+	// Streams cannot contain symbolic links, but a link in the destination could otherwise redirect decoded files outside of Base.
+	// If this is set, an entry is rejected with ErrPathEscape if its path is a symbolic link, or if a parent directory of the entry (or of a hard link target) resolves outside of Base through a symbolic link.
+	// Where supported, regular files are also opened with O_NOFOLLOW.
+	// Links which resolve within Base are still followed in parent directories.
+	NoFollowSymlinks bool
+
+	// Atomic is whether to decode each regular file into a temporary file in the same directory, and rename it into place once it is complete.
+	// This prevents partially decoded files from appearing at their final paths, and the temporary file is removed if decoding fails.
+	// Ownership and extended attributes are applied to the final path after the rename.
+	Atomic bool
 }
 
+// OverwriteMode is a way of handling files which already exist when decoding.
+// Existing directories are always reused.
+type OverwriteMode uint8
+
+const (
+	// OverwriteTruncate replaces the contents of existing regular files.
+	OverwriteTruncate OverwriteMode = iota
+
+	// OverwriteFail fails with an error satisfying errors.Is(err, os.ErrExist) when a file already exists.
+	OverwriteFail
+
+	// OverwriteSkip leaves existing files untouched, and skips their entries in the stream.
+	OverwriteSkip
+)
+
+// ErrFileTooLarge indicates that a file in a stream exceeded DecodeOptions.MaxFileSize.
+var ErrFileTooLarge = errors.New("file exceeds maximum size")
+
+// ErrTotalTooLarge indicates that the files in a stream exceeded DecodeOptions.MaxTotalSize.
+var ErrTotalTooLarge = errors.New("files exceed maximum total size")
+
+// ErrTooManyFiles indicates that a stream contained more than DecodeOptions.MaxFiles entries.
+var ErrTooManyFiles = errors.New("too many files")
+
+// ErrPathTooLong indicates that a path in a stream exceeded DecodeOptions.MaxPathLength.
+var ErrPathTooLong = errors.New("path too long")
+
+// ErrPathEscape indicates that a path in a stream would be decoded outside of the base directory.
+var ErrPathEscape = errors.New("path escapes base directory")
+
 // DecodeFiles decodes a filestream to the filesystem.
 func DecodeFiles(src *Reader, opts DecodeOptions) error {
+	return DecodeFilesContext(context.Background(), src, opts)
+}
+
+// DecodeFilesContext decodes a filestream to the filesystem, stopping early if the context is cancelled.
+// If the context is cancelled while a file is being decoded, the file is left incomplete.
+func DecodeFilesContext(ctx context.Context, src *Reader, opts DecodeOptions) error {
 	if opts.DefaultOpts.Permissions == 0 {
 		opts.DefaultOpts.Permissions = 0640
 	}
+	if opts.DefaultDirOpts.Permissions == 0 {
+		opts.DefaultDirOpts.Permissions = opts.DefaultOpts.Permissions | 0100
+	}
+	if opts.ApplyUmask {
+		mask := umask()
+		opts.DefaultOpts.Permissions &^= mask
+		opts.DefaultDirOpts.Permissions &^= mask
+	}
 	if opts.Base == "" {
 		wd, err := os.Getwd()
 		if err != nil {
@@ -160,14 +828,90 @@ func DecodeFiles(src *Reader, opts DecodeOptions) error {
 		}
 		opts.Base = wd
 	}
+	var realBase string
+	if opts.NoFollowSymlinks {
+		var err error
+		realBase, err = filepath.EvalSymlinks(opts.Base)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.MaxChunkSize > 0 && opts.MaxChunkSize < src.maxChunkSize {
+		defer func(max int64) { src.maxChunkSize = max }(src.maxChunkSize)
+		src.maxChunkSize = opts.MaxChunkSize
+	}
+	var total *limitedReader
+	if opts.MaxTotalSize > 0 {
+		total = &limitedReader{n: opts.MaxTotalSize, err: ErrTotalTooLarge}
+	}
+	var count int
 	for src.Next() {
+		// stop if cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		fr := src.File()
 
-		path := filepath.Join(opts.Base, fr.Path())
+		// apply entry limits
+		count++
+		if opts.MaxFiles > 0 && count > opts.MaxFiles {
+			return ErrTooManyFiles
+		}
+		if opts.MaxPathLength > 0 && (len(fr.Path()) > opts.MaxPathLength || len(fr.HardlinkTo()) > opts.MaxPathLength) {
+			return ErrPathTooLong
+		}
+
+		// apply size limits
+		var body io.Reader = ctxReader{ctx, fr}
+		if size, ok := fr.Size(); ok {
+			// reject oversized files before preallocating them
+			if opts.MaxFileSize > 0 && size > opts.MaxFileSize {
+				return ErrFileTooLarge
+			}
+			if total != nil && size > total.n {
+				return ErrTotalTooLarge
+			}
+		}
+		if opts.MaxFileSize > 0 {
+			body = &limitedReader{r: body, n: opts.MaxFileSize, err: ErrFileTooLarge}
+		}
+		if total != nil {
+			total.r = body
+			body = total
+		}
+
+		name, target := fr.Path(), fr.HardlinkTo()
+		ok := true
+		if opts.StripComponents > 0 {
+			name, ok = stripComponents(name, opts.StripComponents)
+			if ok && target != "" {
+				target, ok = stripComponents(target, opts.StripComponents)
+			}
+		}
+		if ok && opts.Rewrite != nil {
+			name, ok = opts.Rewrite(name)
+			if ok && target != "" {
+				target, ok = opts.Rewrite(target)
+			}
+		}
+		if !ok {
+			err := fr.Skip()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		path, err := resolvePath(opts.Base, name, opts.AllowAbsolute, opts.StripAbsolute)
+		if err != nil {
+			return err
+		}
 
 		fo := fr.Opts()
 		if !opts.PreservePermissions {
-			fo.Permissions = fo.Permissions &^ os.ModePerm
+			fo.Permissions = fo.Permissions &^ (os.ModePerm | specialPermissions)
+			fo.ExactPermissions = false
 		}
 		if !opts.PreserveUser {
 			fo.User = ""
@@ -175,32 +919,100 @@ func DecodeFiles(src *Reader, opts DecodeOptions) error {
 		if !opts.PreserveGroup {
 			fo.Group = ""
 		}
-		if fo.Permissions&os.ModePerm == 0 {
-			fo.Permissions |= opts.DefaultOpts.Permissions
-			if (fo.Permissions & os.ModeDir) != 0 {
-				fo.Permissions |= 0100
+		if !opts.PreserveXattrs {
+			fo.Xattrs = nil
+		}
+		if fo.Permissions&os.ModePerm == 0 && !fo.ExactPermissions {
+			if fo.Permissions.IsDir() {
+				fo.Permissions |= opts.DefaultDirOpts.Permissions & os.ModePerm
+			} else {
+				fo.Permissions |= opts.DefaultOpts.Permissions & os.ModePerm
 			}
 		}
 
+		if fo.Permissions&os.ModeDevice != 0 && !opts.CreateDevices {
+			// skip device nodes unless they were explicitly requested
+			continue
+		}
+
+		if opts.Overwrite == OverwriteSkip && !opts.DryRun && !fo.Permissions.IsDir() {
+			_, err := os.Lstat(path)
+			if err == nil {
+				err = fr.Skip()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if opts.NoFollowSymlinks && !opts.DryRun {
+			err := checkSymlinks(opts.Base, realBase, path, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		var n int64
 		switch {
+		case opts.DryRun:
+			if fr.HardlinkTo() != "" {
+				_, err := resolvePath(opts.Base, target, opts.AllowAbsolute, opts.StripAbsolute)
+				if err != nil {
+					return err
+				}
+			} else if fo.Permissions&os.ModeType&^(os.ModeDir|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0 {
+				return errors.New("cannot decode special file")
+			}
+
+			// read the body to validate it
+			n, err = io.Copy(ioutil.Discard, body)
+			if err != nil {
+				return err
+			}
+		case fr.HardlinkTo() != "":
+			target, err := resolvePath(opts.Base, target, opts.AllowAbsolute, opts.StripAbsolute)
+			if err != nil {
+				return err
+			}
+			if opts.NoFollowSymlinks {
+				err = checkSymlinks(opts.Base, realBase, target, false)
+				if err != nil {
+					return err
+				}
+			}
+			err = os.Link(target, path)
+			if err != nil {
+				return err
+			}
 		case fo.Permissions.IsDir():
 			err := os.MkdirAll(path, fo.Permissions&os.ModePerm)
 			if err != nil {
 				return err
 			}
 		case fo.Permissions.IsRegular():
-			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, fo.Permissions)
+			f, err := createFile(path, fo.Permissions, opts)
 			if err != nil {
 				return err
 			}
-
-			_, err = io.Copy(f, fr)
-			if err != nil {
+			n, err = writeBody(f, body, fr, src.hdr.Sparse)
+			if err == nil {
+				err = f.Close()
+			} else {
 				f.Close()
+			}
+			if err == nil && opts.Atomic {
+				err = os.Rename(f.Name(), path)
+			}
+			if err != nil {
+				if opts.Atomic {
+					os.Remove(f.Name())
+				}
 				return err
 			}
-
-			err = f.Close()
+		case fo.Permissions&(os.ModeNamedPipe|os.ModeDevice) != 0:
+			major, minor := fr.Device()
+			err := mknod(path, fo.Permissions, major, minor)
 			if err != nil {
 				return err
 			}
@@ -208,12 +1020,230 @@ func DecodeFiles(src *Reader, opts DecodeOptions) error {
 			return errors.New("cannot decode special file")
 		}
 
-		if fo.User != "" || fo.Group != "" {
-			err := chown(path, fo)
-			if err != nil {
-				return err
+		// hard links share ownership and attributes with the target
+		if !opts.DryRun && fr.HardlinkTo() == "" {
+			if len(fo.Xattrs) > 0 {
+				err := setXattrs(path, fo.Xattrs)
+				if err != nil {
+					return err
+				}
+			}
+			if fo.User != "" || fo.Group != "" {
+				err := chown(path, fo)
+				if err != nil {
+					return err
+				}
+			}
+
+			// the special bits passed on creation may be masked by the umask, and may be cleared by chown, so set them explicitly last
+			if fo.Permissions&specialPermissions != 0 {
+				err := os.Chmod(path, fo.Permissions&(os.ModePerm|specialPermissions))
+				if err != nil {
+					return err
+				}
 			}
 		}
+
+		if opts.OnEntry != nil {
+			opts.OnEntry(path, fo, n)
+		}
 	}
 	return src.Err()
 }
+
+// createFile creates a regular file to decode into.
+// In atomic mode, this is a temporary file in the same directory, which must be renamed into place once it is complete.
+func createFile(path string, mode os.FileMode, opts DecodeOptions) (*os.File, error) {
+	if !opts.Atomic {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if opts.Overwrite == OverwriteFail {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+		}
+		if opts.NoFollowSymlinks {
+			flags |= oNoFollow
+		}
+		return os.OpenFile(path, flags, mode)
+	}
+
+	// the rename would replace an existing file, so check for one first
+	if opts.Overwrite == OverwriteFail {
+		_, err := os.Lstat(path)
+		if err == nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+		}
+	}
+	return createTemp(path, mode)
+}
+
+// createTemp creates a new temporary file alongside the given path.
+// Unlike ioutil.TempFile, the file is created with the given mode, so that the OS applies the umask to it as it would to the file itself.
+func createTemp(path string, mode os.FileMode) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10), os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// writeBody copies the body of a file into a newly created file on the filesystem.
+// It returns the number of bytes in the body.
+func writeBody(f *os.File, body io.Reader, fr *FileReader, sparse bool) (int64, error) {
+	// recreate holes by seeking over zero blocks, which relies on the file starting empty
+	var out io.Writer = struct{ io.Writer }{f} // hide ReadFrom so that the buffer is used
+	var sw *sparseWriter
+	if sparse {
+		sw = &sparseWriter{f: f}
+		out = sw
+	}
+
+	// preallocate file if the size is known
+	size, sized := fr.Size()
+	if sized {
+		err := f.Truncate(size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	n, err := io.CopyBuffer(out, body, *buf)
+	copyBuffers.Put(buf)
+	if err != nil {
+		return n, err
+	}
+	if sw != nil {
+		err = sw.finish(n)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// fix up the length if the size hint was wrong
+	if sized && n != size {
+		err = f.Truncate(n)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// checkSymlinks checks that decoding to a path within the base directory would not follow a symbolic link outside of it.
+// The base is the directory as given, and realBase is the same directory with symbolic links resolved.
+// If final is set, the path itself must not be a symbolic link.
+// Paths outside of the base (which are only possible with AllowAbsolute) are not checked.
+func checkSymlinks(base, realBase, path string, final bool) error {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	if final {
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symbolic link %q: %w", path, ErrPathEscape)
+		}
+	}
+
+	// resolve the deepest parent which exists, as the rest will be created as directories
+	dir := filepath.Dir(path)
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			rel, err := filepath.Rel(realBase, real)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("%q resolves to %q through a symbolic link: %w", dir, real, ErrPathEscape)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// stripComponents removes the first n components of a path from a stream.
+// It returns false if the path does not have more than n components.
+func stripComponents(p string, n int) (string, bool) {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(p), "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) <= n {
+		return "", false
+	}
+	return strings.Join(parts[n:], "/"), true
+}
+
+// resolvePath resolves a path from a stream to a location on the filesystem.
+// It returns an error wrapping ErrPathEscape if the path would be outside of the base directory.
+func resolvePath(base, p string, allowAbsolute, stripAbsolute bool) (string, error) {
+	if filepath.IsAbs(p) || strings.HasPrefix(filepath.ToSlash(p), "/") {
+		switch {
+		case stripAbsolute:
+			// resolve the rest of the path relative to the base
+			p = strings.TrimLeft(filepath.ToSlash(p[len(filepath.VolumeName(p)):]), "/")
+		case allowAbsolute:
+			return filepath.Clean(p), nil
+		default:
+			return "", fmt.Errorf("absolute path %q: %w", p, ErrPathEscape)
+		}
+	}
+
+	resolved := filepath.Join(base, filepath.FromSlash(p))
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q: %w", p, ErrPathEscape)
+	}
+
+	return resolved, nil
+}
+
+// limitedReader is an io.Reader which fails once more than a limit has been read.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (lr *limitedReader) Read(dst []byte) (int, error) {
+	// read at most one byte past the limit to detect overflow
+	if lr.n < math.MaxInt64 && int64(len(dst)) > lr.n+1 {
+		dst = dst[:lr.n+1]
+	}
+	n, err := lr.r.Read(dst)
+	if int64(n) > lr.n {
+		n = int(lr.n)
+		lr.n = 0
+		return n, lr.err
+	}
+	lr.n -= int64(n)
+	return n, err
+}
+
+// ctxReader is an io.Reader which stops reading once a context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(dat []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(dat)
+}
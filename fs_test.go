@@ -0,0 +1,1737 @@
+package filestream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+// writeTree creates a temporary directory containing the given files.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "filestream-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// encodeTree encodes a directory into an in-memory stream.
+func encodeTree(t *testing.T, dir string, sopts filestream.StreamOptions, eopts filestream.EncodeOptions) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, sopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, dir, eopts)
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// streamPaths lists the paths of the entries in a stream.
+func streamPaths(t *testing.T, dat []byte) []string {
+	t.Helper()
+
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for r.Next() {
+		paths = append(paths, filepath.ToSlash(r.File().Path()))
+		err = r.File().Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestEncodeSize(t *testing.T) {
+	dir := writeTree(t, map[string]string{"hello.txt": "hello world"})
+	defer os.RemoveAll(dir)
+
+	r, err := filestream.NewReader(bytes.NewReader(encodeTree(t, dir, filestream.StreamOptions{}, filestream.EncodeOptions{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		f := r.File()
+		size, ok := f.Size()
+		switch {
+		case f.IsDir():
+			if ok {
+				t.Errorf("unexpected size on directory %q", f.Path())
+			}
+		case !ok:
+			t.Errorf("missing size on %q", f.Path())
+		case size != int64(len("hello world")):
+			t.Errorf("expected size %d but got %d", len("hello world"), size)
+		}
+		_, err = ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("hard link detection is not supported on this platform")
+	}
+
+	src, err := ioutil.TempDir("", "filestream-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	err = ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{DetectHardlinks: true})
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+
+	a, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(dst, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("hard link was not preserved")
+	}
+	dat, err := ioutil.ReadFile(filepath.Join(dst, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dat) != "hello world" {
+		t.Errorf("expected %q but got %q", "hello world", string(dat))
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	dir := writeTree(t, map[string]string{"hello.txt": "hello world"})
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFilesContext(ctx, w, dir, filestream.EncodeOptions{})
+	if err != context.Canceled {
+		t.Errorf("expected encode to be cancelled but got %v", err)
+	}
+
+	r, err := filestream.NewReader(bytes.NewReader(encodeTree(t, dir, filestream.StreamOptions{}, filestream.EncodeOptions{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	err = filestream.DecodeFilesContext(ctx, r, filestream.DecodeOptions{Base: dst})
+	if err != context.Canceled {
+		t.Errorf("expected decode to be cancelled but got %v", err)
+	}
+}
+
+func TestEncodeProgress(t *testing.T) {
+	const size, interval = 1<<20 + 100, 64 << 10
+	dir := writeTree(t, map[string]string{"big.dat": string(make([]byte, size))})
+	defer os.RemoveAll(dir)
+
+	var reports []int64
+	encodeTree(t, dir, filestream.StreamOptions{
+		Progress: func(path string, bytesWritten int64) {
+			if path != "big.dat" {
+				t.Errorf("unexpected progress for %q", path)
+			}
+			reports = append(reports, bytesWritten)
+		},
+		ProgressInterval: interval,
+	}, filestream.EncodeOptions{})
+
+	if len(reports) < 2 {
+		t.Fatalf("expected multiple progress reports but got %v", reports)
+	}
+	for i := 0; i < len(reports)-1; i++ {
+		var prev int64
+		if i > 0 {
+			prev = reports[i-1]
+		}
+		if reports[i]-prev < interval {
+			t.Errorf("progress reported more often than the interval: %v", reports)
+			break
+		}
+	}
+	if last := reports[len(reports)-1]; last != size {
+		t.Errorf("expected final progress of %d but got %d", size, last)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"hello.txt":     "hello world",
+		"empty.txt":     "",
+		"sub/big.dat":   string(bytes.Repeat([]byte("0123456789"), 10000)),
+		"sub/exact.dat": string(make([]byte, 32*1024)),
+	})
+	defer os.RemoveAll(dir)
+
+	estimate, err := filestream.EstimateSize(dir, filestream.EncodeOptions{})
+	if err != nil {
+		t.Fatalf("failed to estimate size: %s", err)
+	}
+	actual := len(encodeTree(t, dir, filestream.StreamOptions{}, filestream.EncodeOptions{}))
+	if estimate != int64(actual) {
+		t.Errorf("estimated %d bytes but encoded %d bytes", estimate, actual)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	files := map[string]string{
+		"b.txt":       "bee",
+		"a/z.txt":     "zed",
+		"a/y/x.txt":   "ex",
+		"run.sh":      "#!/bin/sh\n",
+		"a/empty.txt": "",
+	}
+	first, second := writeTree(t, files), writeTree(t, files)
+	defer os.RemoveAll(first)
+	defer os.RemoveAll(second)
+
+	// vary the permissions between the trees
+	err := os.Chmod(filepath.Join(first, "b.txt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filepath.Join(first, "run.sh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(filepath.Join(second, "run.sh"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eopts := filestream.EncodeOptions{
+		IncludePermissions: true,
+		Deterministic:      true,
+	}
+	sopts := filestream.StreamOptions{Checksums: true}
+	a := encodeTree(t, first, sopts, eopts)
+	b := encodeTree(t, second, sopts, eopts)
+	if !bytes.Equal(a, b) {
+		t.Errorf("encodings differ:\n%q\n%q", a, b)
+	}
+	if !bytes.Equal(a, encodeTree(t, first, sopts, eopts)) {
+		t.Error("encodings of the same tree differ")
+	}
+}
+
+func TestEncodeFilters(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"main.go":                 "package main",
+		"scratch.tmp":             "temporary",
+		"lib/lib.go":              "package lib",
+		"lib/lib.tmp":             "temporary",
+		"lib/README":              "docs",
+		".git/HEAD":               "ref: refs/heads/master",
+		"node_modules/x/index.js": "module.exports = {}",
+	})
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Name             string
+		Exclude, Include []string
+		Paths            []string
+	}{
+		{
+			Name:    "Exclude",
+			Exclude: []string{".git", "node_modules", "*.tmp"},
+			Paths:   []string{".", "lib", "lib/README", "lib/lib.go", "main.go"},
+		},
+		{
+			Name:    "Include",
+			Include: []string{"*.go"},
+			Paths:   []string{".", ".git", "lib", "lib/lib.go", "main.go", "node_modules", "node_modules/x"},
+		},
+		{
+			Name:    "Precedence",
+			Exclude: []string{"lib/*.go", ".git", "node_modules"},
+			Include: []string{"*.go", "*.tmp"},
+			Paths:   []string{".", "lib", "lib/lib.tmp", "main.go", "scratch.tmp"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dat := encodeTree(t, dir, filestream.StreamOptions{}, filestream.EncodeOptions{
+				Exclude: tc.Exclude,
+				Include: tc.Include,
+			})
+			if diff := cmp.Diff(tc.Paths, streamPaths(t, dat)); diff != "" {
+				t.Errorf("unexpected paths (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, dir, filestream.EncodeOptions{Exclude: []string{"["}})
+	if err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestEncodeFilter(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"small.txt":     "tiny",
+		"big.txt":       string(bytes.Repeat([]byte("x"), 1024)),
+		"sub/small.txt": "tiny",
+		"sub/big.txt":   string(bytes.Repeat([]byte("x"), 1024)),
+	})
+	defer os.RemoveAll(dir)
+
+	var seen []string
+	dat := encodeTree(t, dir, filestream.StreamOptions{}, filestream.EncodeOptions{
+		Filter: func(path string, info os.FileInfo) bool {
+			seen = append(seen, filepath.ToSlash(path))
+			return info.IsDir() || info.Size() <= 512
+		},
+	})
+	if diff := cmp.Diff([]string{".", "small.txt", "sub", "sub/small.txt"}, streamPaths(t, dat)); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{".", "big.txt", "small.txt", "sub", "sub/big.txt", "sub/small.txt"}, seen); diff != "" {
+		t.Errorf("unexpected filter calls (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecodePathEscape(t *testing.T) {
+	base, err := ioutil.TempDir("", "filestream-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	dst := filepath.Join(base, "dst")
+	err = os.Mkdir(dst, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := filepath.Join(base, "abs.txt")
+
+	tests := []struct {
+		Name   string
+		Encode func(w *filestream.Writer) error
+	}{
+		{"Parent", func(w *filestream.Writer) error {
+			return w.Directory("../escape", filestream.FileOptions{})
+		}},
+		{"Nested", func(w *filestream.Writer) error {
+			return w.Directory("sub/../../escape", filestream.FileOptions{})
+		}},
+		{"Absolute", func(w *filestream.Writer) error {
+			return w.Directory(abs, filestream.FileOptions{})
+		}},
+		{"HardlinkTarget", func(w *filestream.Writer) error {
+			return w.Hardlink("passwd", "./sub/../../../etc/passwd", filestream.FileOptions{})
+		}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tc.Encode(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := filestream.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+			if !errors.Is(err, filestream.ErrPathEscape) {
+				t.Errorf("expected path escape error but got %v", err)
+			}
+			entries, err := ioutil.ReadDir(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("expected only the destination in the base directory but found %d entries", len(entries))
+			}
+		})
+	}
+
+	// absolute paths may be explicitly allowed
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory(abs, filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, AllowAbsolute: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(abs); err != nil {
+		t.Errorf("absolute path not decoded: %s", err)
+	}
+}
+
+func TestStripAbsolute(t *testing.T) {
+	src := writeTree(t, map[string]string{"sub/hello.txt": "hello"})
+	defer os.RemoveAll(src)
+	dat := encodeTree(t, src, filestream.StreamOptions{}, filestream.EncodeOptions{Base: "/"})
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// decode under a relative base
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := filepath.Rel(wd, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// absolute paths are rejected by default
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: base})
+	if !errors.Is(err, filestream.ErrPathEscape) {
+		t.Errorf("expected path escape error but got %v", err)
+	}
+
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: base, StripAbsolute: true, AllowAbsolute: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := strings.TrimPrefix(src[len(filepath.VolumeName(src)):], string(filepath.Separator))
+	got, err := ioutil.ReadFile(filepath.Join(dst, rel, "sub", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("expected %q but got %q", "hello", got)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"project", "project/sub"} {
+		err = w.Directory(path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"project/a.txt", "project/sub/b.txt", "top.txt"} {
+		err = w.WriteFile(path, []byte(path), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Hardlink("project/link.txt", "project/a.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	tests := []struct {
+		N     int
+		Files map[string]string
+	}{
+		{1, map[string]string{"a.txt": "project/a.txt", "sub/b.txt": "project/sub/b.txt", "link.txt": "project/a.txt"}},
+		{2, map[string]string{"b.txt": "project/sub/b.txt"}},
+		{5, map[string]string{}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(strconv.Itoa(tc.N), func(t *testing.T) {
+			dst, err := ioutil.TempDir("", "filestream-dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dst)
+
+			r, err := filestream.NewReader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, StripComponents: tc.N})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files := map[string]string{}
+			err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				dat, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(dst, path)
+				if err != nil {
+					return err
+				}
+				files[filepath.ToSlash(rel)] = string(dat)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.Files, files); diff != "" {
+				t.Errorf("unexpected files (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"usr", "usr/local"} {
+		err = w.Directory(path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"usr/local/tool.txt", "skip.txt", "old.txt"} {
+		err = w.WriteFile(path, []byte(path), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Hardlink("usr/local/link.txt", "usr/local/tool.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// map usr/local to opt, rename one file, and skip another
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base: dst,
+		Rewrite: func(path string) (string, bool) {
+			switch {
+			case path == "usr" || path == "skip.txt":
+				return "", false
+			case path == "old.txt":
+				return "new.txt", true
+			case strings.HasPrefix(path, "usr/local"):
+				return "opt" + strings.TrimPrefix(path, "usr/local"), true
+			}
+			return path, true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(dat)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"opt/tool.txt": "usr/local/tool.txt",
+		"opt/link.txt": "usr/local/tool.txt",
+		"new.txt":      "old.txt",
+	}
+	if diff := cmp.Diff(expect, files); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+	// rewritten paths are still checked
+	dst2, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst2)
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base: dst2,
+		Rewrite: func(path string) (string, bool) {
+			return "../" + path, true
+		},
+	})
+	if !errors.Is(err, filestream.ErrPathEscape) {
+		t.Errorf("expected path escape error but got %v", err)
+	}
+}
+
+func TestDecodeDryRun(t *testing.T) {
+	src := writeTree(t, map[string]string{
+		"hello.txt":     "hello world",
+		"sub/empty.txt": "",
+	})
+	defer os.RemoveAll(src)
+	dat := encodeTree(t, src, filestream.StreamOptions{Checksums: true}, filestream.EncodeOptions{})
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	type entry struct {
+		Path string
+		Dir  bool
+		Size int64
+	}
+	var entries []entry
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:   dst,
+		DryRun: true,
+		OnEntry: func(path string, opts filestream.FileOptions, size int64) {
+			rel, err := filepath.Rel(dst, path)
+			if err != nil {
+				t.Error(err)
+			}
+			entries = append(entries, entry{filepath.ToSlash(rel), opts.Permissions.IsDir(), size})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []entry{
+		{".", true, 0},
+		{"hello.txt", false, int64(len("hello world"))},
+		{"sub", true, 0},
+		{"sub/empty.txt", false, 0},
+	}
+	if diff := cmp.Diff(expect, entries); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+	files, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("dry run created %d files", len(files))
+	}
+
+	// errors in the stream are still detected
+	dat[bytes.Index(dat, []byte("hello world"))] = 'H'
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, DryRun: true})
+	if !errors.Is(err, filestream.ErrChecksum) {
+		t.Errorf("expected checksum error but got %v", err)
+	}
+}
+
+func TestDecodeSizeLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("sized.txt", bytes.Repeat([]byte("x"), 100), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("chunked.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = fw.Write(bytes.Repeat([]byte("y"), 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	tests := []struct {
+		Name string
+		Opts filestream.DecodeOptions
+		Err  error
+	}{
+		{"Unlimited", filestream.DecodeOptions{}, nil},
+		{"Sufficient", filestream.DecodeOptions{MaxFileSize: 200, MaxTotalSize: 300}, nil},
+		{"SizedFile", filestream.DecodeOptions{MaxFileSize: 99}, filestream.ErrFileTooLarge},
+		{"ChunkedFile", filestream.DecodeOptions{MaxFileSize: 150}, filestream.ErrFileTooLarge},
+		{"Total", filestream.DecodeOptions{MaxTotalSize: 250}, filestream.ErrTotalTooLarge},
+		{"MaxInt64", filestream.DecodeOptions{MaxFileSize: math.MaxInt64, MaxTotalSize: math.MaxInt64}, nil},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dst, err := ioutil.TempDir("", "filestream-dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dst)
+
+			r, err := filestream.NewReader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.Opts.Base = dst
+			err = filestream.DecodeFiles(r, tc.Opts)
+			if !errors.Is(err, tc.Err) {
+				t.Errorf("expected error %v but got %v", tc.Err, err)
+			}
+		})
+	}
+}
+
+func TestDecodeEntryLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "b", "c", strings.Repeat("d", 200)} {
+		err = w.Directory(path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	tests := []struct {
+		Name string
+		Opts filestream.DecodeOptions
+		Err  error
+	}{
+		{"Sufficient", filestream.DecodeOptions{MaxFiles: 4, MaxPathLength: 200}, nil},
+		{"Files", filestream.DecodeOptions{MaxFiles: 3}, filestream.ErrTooManyFiles},
+		{"PathLength", filestream.DecodeOptions{MaxPathLength: 199}, filestream.ErrPathTooLong},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			r, err := filestream.NewReader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.Opts.DryRun = true
+			err = filestream.DecodeFiles(r, tc.Opts)
+			if !errors.Is(err, tc.Err) {
+				t.Errorf("expected error %v but got %v", tc.Err, err)
+			}
+		})
+	}
+}
+
+func TestZeroMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported on windows")
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("locked.txt", []byte("no access"), filestream.FileOptions{ExactPermissions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("default.txt", []byte("defaults"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	// the reader must distinguish a zero mode from a missing mode
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact := map[string]bool{}
+	for r.Next() {
+		opts := r.File().Opts()
+		if opts.Permissions != 0 {
+			t.Errorf("unexpected permissions %v on %q", opts.Permissions, r.File().Path())
+		}
+		exact[r.File().Path()] = opts.ExactPermissions
+		_, err = ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]bool{"locked.txt": true, "default.txt": false}, exact); diff != "" {
+		t.Errorf("unexpected permission presence (-want +got):\n%s", diff)
+	}
+
+	// decoding should restore the zero mode, and use defaults only where the mode was missing
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:                dst,
+		PreservePermissions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, mode := range map[string]os.FileMode{"locked.txt": 0, "default.txt": 0640} {
+		info, err := os.Stat(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected mode %v on %q but got %v", mode, path, info.Mode().Perm())
+		}
+	}
+}
+
+func TestDefaultDirOpts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported on windows")
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("default", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("preserved", filestream.FileOptions{Permissions: 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("default/file.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	tests := []struct {
+		Name   string
+		Opts   filestream.DecodeOptions
+		Expect map[string]os.FileMode
+	}{
+		{
+			Name: "Separate",
+			Opts: filestream.DecodeOptions{
+				PreservePermissions: true,
+				DefaultOpts:         filestream.FileOptions{Permissions: 0644},
+				DefaultDirOpts:      filestream.FileOptions{Permissions: 0755},
+			},
+			Expect: map[string]os.FileMode{"default": 0755, "preserved": 0750, "default/file.txt": 0644},
+		},
+		{
+			Name: "Derived",
+			Opts: filestream.DecodeOptions{
+				PreservePermissions: true,
+				DefaultOpts:         filestream.FileOptions{Permissions: 0600},
+			},
+			Expect: map[string]os.FileMode{"default": 0700, "preserved": 0750, "default/file.txt": 0600},
+		},
+		{
+			Name: "NotPreserved",
+			Opts: filestream.DecodeOptions{
+				DefaultDirOpts: filestream.FileOptions{Permissions: 0711},
+			},
+			Expect: map[string]os.FileMode{"default": 0711, "preserved": 0711, "default/file.txt": 0640},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dst, err := ioutil.TempDir("", "filestream-dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dst)
+
+			r, err := filestream.NewReader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := tc.Opts
+			opts.Base = dst
+			err = filestream.DecodeFiles(r, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for path, mode := range tc.Expect {
+				info, err := os.Stat(filepath.Join(dst, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Errorf("expected mode %v on %q but got %v", mode, path, info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	// the new file is written without a size, so the existing file is not truncated by preallocation
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("file.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.Write([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("other.txt", []byte("other"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	const stale = "stale data which is longer than the new file"
+	tests := []struct {
+		Name   string
+		Mode   filestream.OverwriteMode
+		Err    error
+		Expect map[string]string
+	}{
+		{"Truncate", filestream.OverwriteTruncate, nil, map[string]string{"file.txt": "new", "other.txt": "other"}},
+		{"Fail", filestream.OverwriteFail, os.ErrExist, map[string]string{"file.txt": stale}},
+		{"Skip", filestream.OverwriteSkip, nil, map[string]string{"file.txt": stale, "other.txt": "other"}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dst := writeTree(t, map[string]string{"file.txt": stale})
+			defer os.RemoveAll(dst)
+
+			r, err := filestream.NewReader(bytes.NewReader(dat))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, Overwrite: tc.Mode})
+			if !errors.Is(err, tc.Err) {
+				t.Fatalf("expected error %v but got %v", tc.Err, err)
+			}
+
+			got := map[string]string{}
+			infos, err := ioutil.ReadDir(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range infos {
+				data, err := ioutil.ReadFile(filepath.Join(dst, info.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[info.Name()] = string(data)
+			}
+			if diff := cmp.Diff(tc.Expect, got); diff != "" {
+				t.Errorf("unexpected files (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00\x01\x02", 1000)
+	text := strings.Repeat("hello world\n", 100)
+	files := map[string]string{"image.png": png, "notes.txt": text}
+	src := writeTree(t, files)
+	defer os.RemoveAll(src)
+
+	dat := encodeTree(t, src, filestream.StreamOptions{}, filestream.EncodeOptions{DetectContentType: true})
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]string{}
+	for r.Next() {
+		fr := r.File()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.IsDir() {
+			continue
+		}
+		types[fr.Path()] = fr.ContentType()
+
+		// the sniffed data must not be lost from the body
+		if string(data) != files[fr.Path()] {
+			t.Errorf("body of %q was corrupted", fr.Path())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"image.png": "image/png", "notes.txt": "text/plain; charset=utf-8"}
+	if diff := cmp.Diff(expect, types); diff != "" {
+		t.Errorf("unexpected content types (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompressionSelector(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	media := make([]byte, 8192)
+	rng.Read(media)
+	files := map[string]string{
+		"photo.jpg":    string(media),
+		"notes.txt":    strings.Repeat("hello world\n", 100),
+		"logs/app.log": strings.Repeat("INFO started\n", 100),
+		"empty.txt":    "",
+	}
+	src := writeTree(t, files)
+	defer os.RemoveAll(src)
+
+	// store media as it is, and compress everything else
+	selector := func(path string, info os.FileInfo) string {
+		if filepath.Ext(path) == ".jpg" {
+			return ""
+		}
+		return "gzip"
+	}
+	dat := encodeTree(t, src, filestream.StreamOptions{PerFileCompression: true, Sparse: true}, filestream.EncodeOptions{
+		CompressionSelector: selector,
+		DetectSparse:        true,
+	})
+
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compression := map[string]string{}
+	for r.Next() {
+		fr := r.File()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.IsDir() {
+			continue
+		}
+		compression[fr.Path()] = fr.Opts().Compression
+		if string(data) != files[fr.Path()] {
+			t.Errorf("body of %q was corrupted", fr.Path())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{
+		"photo.jpg":                      "",
+		"notes.txt":                      "gzip",
+		filepath.Join("logs", "app.log"): "gzip",
+		"empty.txt":                      "gzip",
+	}
+	if diff := cmp.Diff(expect, compression); diff != "" {
+		t.Errorf("unexpected compression (-want +got):\n%s", diff)
+	}
+
+	// the stream must also decode to the filesystem
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("decoded %q was corrupted", path)
+		}
+	}
+
+	// the stream must allow per-file compression
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{CompressionSelector: selector})
+	if err == nil {
+		t.Error("selected compression without per-file compression enabled")
+	}
+}
+
+func TestSkipIncompressible(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 256<<10)
+	rng.Read(random)
+	files := map[string]string{
+		"random.bin": string(random),
+		"notes.txt":  strings.Repeat("hello world\n", 10000),
+		"empty.txt":  "",
+	}
+	src := writeTree(t, files)
+	defer os.RemoveAll(src)
+
+	dat := encodeTree(t, src, filestream.StreamOptions{PerFileCompression: true}, filestream.EncodeOptions{
+		CompressionSelector: func(path string, info os.FileInfo) string { return "gzip" },
+		SkipIncompressible:  true,
+	})
+
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compression := map[string]string{}
+	for r.Next() {
+		fr := r.File()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.IsDir() {
+			continue
+		}
+		compression[fr.Path()] = fr.Opts().Compression
+
+		// the sampled data must not be lost from the body
+		if string(data) != files[fr.Path()] {
+			t.Errorf("body of %q was corrupted", fr.Path())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"random.bin": "", "notes.txt": "gzip", "empty.txt": ""}
+	if diff := cmp.Diff(expect, compression); diff != "" {
+		t.Errorf("unexpected compression (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeFilesMulti(t *testing.T) {
+	src := writeTree(t, map[string]string{
+		"one/a.txt":     "a",
+		"one/sub/b.txt": "b",
+		"two/c.txt":     "c",
+		"three/d.txt":   "d",
+	})
+	defer os.RemoveAll(src)
+
+	encode := func(paths []string, opts filestream.EncodeOptions) []string {
+		t.Helper()
+
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.EncodeFilesMulti(w, paths, opts)
+		if err != nil {
+			t.Fatalf("failed to encode: %s", err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return streamPaths(t, buf.Bytes())
+	}
+
+	// sibling directories are encoded under their own names, with the overlapping path only encoded once
+	paths := encode([]string{
+		filepath.Join(src, "two"),
+		filepath.Join(src, "one"),
+		filepath.Join(src, "one", "sub"),
+	}, filestream.EncodeOptions{})
+	expect := []string{"two", "two/c.txt", "one", "one/a.txt", "one/sub", "one/sub/b.txt"}
+	if diff := cmp.Diff(expect, paths); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+
+	// an explicit base is used for all of the paths
+	paths = encode([]string{
+		filepath.Join(src, "one", "sub"),
+		filepath.Join(src, "three"),
+	}, filestream.EncodeOptions{Base: src})
+	expect = []string{"one/sub", "one/sub/b.txt", "three", "three/d.txt"}
+	if diff := cmp.Diff(expect, paths); diff != "" {
+		t.Errorf("unexpected paths with base (-want +got):\n%s", diff)
+	}
+}
+
+func TestEncodeRewrite(t *testing.T) {
+	src := writeTree(t, map[string]string{
+		"a.txt":         "a",
+		"sub/b.txt":     "b",
+		"cache/c.txt":   "c",
+		"cache/d/e.txt": "e",
+	})
+	defer os.RemoveAll(src)
+
+	var visited []string
+	dat := encodeTree(t, src, filestream.StreamOptions{}, filestream.EncodeOptions{
+		Rewrite: func(relPath string, info os.FileInfo) (string, bool) {
+			visited = append(visited, filepath.ToSlash(relPath))
+			if relPath == "cache" {
+				return "", false
+			}
+			return path.Join("payload", filepath.ToSlash(relPath)), true
+		},
+	})
+	expect := []string{"payload", "payload/a.txt", "payload/sub", "payload/sub/b.txt"}
+	if diff := cmp.Diff(expect, streamPaths(t, dat)); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+
+	// the contents of a skipped directory are not visited
+	if diff := cmp.Diff([]string{".", "a.txt", "cache", "sub", "sub/b.txt"}, visited); diff != "" {
+		t.Errorf("unexpected entries visited (-want +got):\n%s", diff)
+	}
+}
+
+func TestSlashPaths(t *testing.T) {
+	// paths are given with the separator of the platform, which is a backslash on Windows
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{StrictPaths: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join("dir", "sub")
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory(dir, filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Hardlink(filepath.Join(dir, "link.txt"), filepath.Join(dir, "file.txt"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+	if bytes.Contains(dat, []byte(`\\`)) {
+		t.Errorf("stream contains backslashes: %q", dat)
+	}
+
+	// the stream always uses "/"
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths, links []string
+	for r.Next() {
+		paths = append(paths, r.File().Path())
+		if r.File().HardlinkTo() != "" {
+			links = append(links, r.File().HardlinkTo())
+		}
+		err = r.File().Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"dir", "dir/sub", "dir/sub/file.txt", "dir/sub/link.txt"}, paths); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"dir/sub/file.txt"}, links); diff != "" {
+		t.Errorf("unexpected link targets (-want +got):\n%s", diff)
+	}
+
+	// decoding converts back to the separator of the platform
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "dir", "sub", "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("expected %q but got %q", "hello", got)
+	}
+
+	// literal backslashes are only converted on platforms where they are a separator
+	type slashCase struct {
+		Name, Path, Link, Expect, ExpectLink string
+	}
+	var cases []slashCase
+	if filepath.Separator == '\\' {
+		cases = []slashCase{
+			{"Backslash", `dir\sub\file.txt`, `dir\sub\link.txt`, "dir/sub/file.txt", "dir/sub/link.txt"},
+			{"Mixed", `dir\sub/file.txt`, `dir/sub\link.txt`, "dir/sub/file.txt", "dir/sub/link.txt"},
+		}
+	} else {
+		cases = []slashCase{
+			{"Backslash", `dir\file.txt`, `dir\link.txt`, `dir\file.txt`, `dir\link.txt`},
+		}
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.WriteFile(tc.Path, []byte("hello"), filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Hardlink(tc.Link, tc.Path, filestream.FileOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := filestream.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][2]string
+			for r.Next() {
+				got = append(got, [2]string{r.File().Path(), r.File().HardlinkTo()})
+				err = r.File().Skip()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Err(); err != nil {
+				t.Fatal(err)
+			}
+			expect := [][2]string{{tc.Expect, ""}, {tc.ExpectLink, tc.Expect}}
+			if diff := cmp.Diff(expect, got); diff != "" {
+				t.Errorf("unexpected paths (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// on platforms where it is not a separator, a backslash is rejected in strict mode
+	if filepath.Separator != '\\' {
+		w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{StrictPaths: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WriteFile(`dir\file.txt`, nil, filestream.FileOptions{})
+		if err == nil {
+			t.Error("strict mode accepted a backslash which is not a separator")
+		}
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	// the file is written without a size, so the size limit is only hit partway through the body
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("small.txt", []byte("small"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.File("big.txt", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err = fw.Write(bytes.Repeat([]byte{'x'}, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:        dst,
+		Atomic:      true,
+		MaxFileSize: 2500,
+	})
+	if !errors.Is(err, filestream.ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge but got %v", err)
+	}
+
+	// only the complete file should exist, and the temporary file should have been cleaned up
+	infos, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if diff := cmp.Diff([]string{"small.txt"}, names); diff != "" {
+		t.Errorf("unexpected files after failed decode (-want +got):\n%s", diff)
+	}
+
+	// without the limit, the file is renamed into place
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, Atomic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "big.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4000 {
+		t.Errorf("expected 4000 bytes but got %d", len(data))
+	}
+	if runtime.GOOS != "windows" {
+		// the umask is applied to the temporary file in the same way as to a file created in place
+		plain, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(plain)
+		r, err = filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: plain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.Stat(filepath.Join(plain, "big.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dst, "big.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0600 != 0600 {
+			t.Errorf("expected default permissions but got %v", info.Mode().Perm())
+		}
+		if info.Mode().Perm() != want.Mode().Perm() {
+			t.Errorf("atomic decode created %v but decoding in place created %v", info.Mode().Perm(), want.Mode().Perm())
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	// a file with a hole in the middle, and a file ending with zeros
+	middle := "start" + strings.Repeat("\x00", 1<<20) + "end"
+	trailing := "data" + strings.Repeat("\x00", 100000)
+	src := writeTree(t, map[string]string{
+		"middle.img":   middle,
+		"trailing.img": trailing,
+		"dense.txt":    "no holes here",
+	})
+	defer os.RemoveAll(src)
+
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{DetectSparse: true})
+	if err == nil {
+		t.Error("detected sparse files in a stream without sparse files enabled")
+	}
+
+	for _, sopts := range []filestream.StreamOptions{
+		{Sparse: true},
+		{Sparse: true, Checksums: true, VarintFraming: true},
+	} {
+		dat := encodeTree(t, src, sopts, filestream.EncodeOptions{DetectSparse: true})
+		// only the blocks containing data should be sent
+		if len(dat) > 4*4096 {
+			t.Errorf("zeros were not encoded as holes: stream is %d bytes", len(dat))
+		}
+
+		dst, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		// holes must be preserved by raw copies
+		rr, err := filestream.NewRawReader(bytes.NewReader(dat), filestream.ReaderOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var copied bytes.Buffer
+		w, err := filestream.NewWriter(&copied, sopts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rr.Next() {
+			err = w.CopyRaw(rr.File())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rr.Err(); err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied.Bytes(), dat) {
+			t.Error("raw copy changed the stream")
+		}
+
+		// holes must read back as zeros, and be recreated when decoding
+		r, err := filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expect := range map[string]string{
+			"middle.img":   middle,
+			"trailing.img": trailing,
+			"dense.txt":    "no holes here",
+		} {
+			got, err := ioutil.ReadFile(filepath.Join(dst, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != expect {
+				t.Errorf("file %q corrupted through sparse encoding", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// +build linux darwin
+
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestApplyUmask(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/default.txt", []byte("defaults"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/preserved.txt", []byte("preserved"), filestream.FileOptions{Permissions: 0604})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	old := syscall.Umask(027)
+	defer syscall.Umask(old)
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:                dst,
+		PreservePermissions: true,
+		ApplyUmask:          true,
+		DefaultOpts:         filestream.FileOptions{Permissions: 0666},
+		DefaultDirOpts:      filestream.FileOptions{Permissions: 0777},
+		OnEntry: func(path string, opts filestream.FileOptions, size int64) {
+			rel, err := filepath.Rel(dst, path)
+			if err != nil {
+				t.Error(err)
+			}
+			modes[filepath.ToSlash(rel)] = opts.Permissions.Perm()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the umask applies to defaults, but not to permissions preserved from the stream
+	expect := map[string]os.FileMode{"dir": 0750, "dir/default.txt": 0640, "dir/preserved.txt": 0604}
+	if diff := cmp.Diff(expect, modes); diff != "" {
+		t.Errorf("unexpected reported modes (-want +got):\n%s", diff)
+	}
+	for _, path := range []string{"dir", "dir/default.txt"} {
+		mode := expect[path]
+		info, err := os.Stat(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected mode %v on %q but got %v", mode, path, info.Mode().Perm())
+		}
+	}
+}
+
+func TestSetgidDirectory(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("shared", filestream.FileOptions{Permissions: os.ModeSetgid | 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("shared/file.txt", []byte("hello"), filestream.FileOptions{Permissions: 0640})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	for _, preserve := range []bool{true, false} {
+		dst, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		r, err := filestream.NewReader(bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, PreservePermissions: preserve})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dst, "shared"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setgid := info.Mode()&os.ModeSetgid != 0; setgid != preserve {
+			t.Errorf("expected setgid=%v with PreservePermissions=%v but got mode %v", preserve, preserve, info.Mode())
+		}
+		if preserve && info.Mode().Perm() != 0750 {
+			t.Errorf("expected permissions 0750 but got %v", info.Mode().Perm())
+		}
+	}
+}
+
+func TestNoFollowSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("out/evil.txt", []byte("evil"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirStream := buf.Bytes()
+
+	buf = bytes.Buffer{}
+	w, err = filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("link.txt", []byte("evil"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileStream := buf.Bytes()
+
+	outside, err := ioutil.TempDir("", "filestream-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	target := filepath.Join(outside, "target.txt")
+	err = ioutil.WriteFile(target, []byte("original"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Directory", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		err = os.Symlink(outside, filepath.Join(dst, "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReader(bytes.NewReader(dirStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, NoFollowSymlinks: true})
+		if !errors.Is(err, filestream.ErrPathEscape) {
+			t.Errorf("expected ErrPathEscape but got %v", err)
+		}
+		_, err = os.Lstat(filepath.Join(outside, "evil.txt"))
+		if !os.IsNotExist(err) {
+			t.Errorf("file was written outside of the base: %v", err)
+		}
+	})
+	t.Run("File", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		err = os.Symlink(target, filepath.Join(dst, "link.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReader(bytes.NewReader(fileStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, NoFollowSymlinks: true})
+		if !errors.Is(err, filestream.ErrPathEscape) {
+			t.Errorf("expected ErrPathEscape but got %v", err)
+		}
+		dat, err := ioutil.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != "original" {
+			t.Errorf("file outside of the base was modified to %q", dat)
+		}
+	})
+	t.Run("Inside", func(t *testing.T) {
+		// links which stay within the base are still followed
+		dst, err := ioutil.TempDir("", "filestream-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		err = os.Mkdir(filepath.Join(dst, "real"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink("real", filepath.Join(dst, "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := filestream.NewReader(bytes.NewReader(dirStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst, NoFollowSymlinks: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, err := ioutil.ReadFile(filepath.Join(dst, "real", "evil.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != "evil" {
+			t.Errorf("expected %q but got %q", "evil", dat)
+		}
+	})
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	outside, err := ioutil.TempDir("", "filestream-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	err = ioutil.WriteFile(filepath.Join(outside, "data.txt"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := ioutil.TempDir("", "filestream-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	err = ioutil.WriteFile(filepath.Join(src, "file.txt"), []byte("file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(src, "linked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file.txt", filepath.Join(src, "link.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(src, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("..", filepath.Join(src, "sub", "cycle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := filestream.DecodeToMap(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]byte{
+		"file.txt":        []byte("file"),
+		"link.txt":        []byte("file"),
+		"linked/data.txt": []byte("data"),
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+
+	// the link back to the top level directory is not followed
+	r, err := filestream.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for r.Next() {
+		paths = append(paths, r.File().Path())
+		err = r.File().Skip()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{".", "file.txt", "link.txt", "linked", "linked/data.txt", "sub"}, paths); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+
+	// without following, the links are rejected
+	w, err = filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{})
+	if err == nil {
+		t.Error("encoded symbolic links without following them")
+	}
+}
@@ -0,0 +1,94 @@
+// +build go1.18
+
+package filestream_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+// FuzzReader checks that the decoder does not panic on arbitrary input.
+// Errors are expected, as most inputs are not valid streams.
+func FuzzReader(f *testing.F) {
+	// seed with the valid streams from the round trip tests
+	for _, c := range roundTripTests {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, c.StreamOpts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, v := range c.Files {
+			if v.Dir {
+				err = w.Directory(v.Path, v.Opts)
+			} else {
+				err = w.WriteFile(v.Path, []byte(v.Data), v.Opts)
+			}
+			if err != nil {
+				f.Fatal(err)
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+
+	// seed with other framing features
+	for _, opts := range []filestream.StreamOptions{
+		{VarintFraming: true},
+		{CompactTerminator: true},
+		{Index: true},
+		{Manifest: &filestream.Manifest{Files: []filestream.ManifestEntry{{Path: "file.txt", Size: 5}}}},
+	} {
+		var buf bytes.Buffer
+		w, err := filestream.NewWriter(&buf, opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		fw, err := w.File("file.txt", filestream.FileOptions{})
+		if err != nil {
+			f.Fatal(err)
+		}
+		_, err = fw.Write([]byte("hello"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+
+	// holes are only written by EncodeFiles, so the sparse seed is written by hand
+	f.Add([]byte("{\"version\":5,\"sparse\":true}\n\x00{\"path\":\"sparse.bin\"}\n\x005\x00hello9223372036854775807\x004096\x000\x00{\"path\":\"\\u0000\"}\n\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, opts := range []filestream.ReaderOptions{{}, {SkipCorruptFiles: true}} {
+			r, err := filestream.NewReaderWithOptions(bytes.NewReader(data), opts)
+			if err != nil {
+				continue
+			}
+			r.Manifest()
+			for r.Next() {
+				fr := r.File()
+				fr.Path()
+				fr.Opts()
+				_, err := io.Copy(ioutil.Discard, fr)
+				if err != nil && !opts.SkipCorruptFiles {
+					break
+				}
+			}
+			r.Err()
+		}
+	})
+}
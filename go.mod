@@ -3,6 +3,8 @@ module github.com/jaddr2line/filestream
 go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/google/go-cmp v0.2.0
 	github.com/pierrec/lz4 v2.1.1+incompatible
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 )
@@ -0,0 +1,218 @@
+package filestream
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// parallelGzipBlockSize is the amount of data compressed by each worker of a parallel gzip writer.
+	parallelGzipBlockSize = 1 << 20
+
+	// parallelGzipDictSize is the amount of data from the previous block used as a dictionary for the next block.
+	parallelGzipDictSize = 32 * 1024
+)
+
+// gzipHeader is a minimal gzip member header, with no timestamp, flags, or OS.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}
+
+// parallelGzipWriter compresses data into a single gzip member, deflating blocks concurrently.
+// Each block is primed with the end of the previous block as a dictionary, and all but the last block end with a sync flush.
+// This means the concatenated blocks form one valid deflate stream, which can be read by any gzip reader.
+type parallelGzipWriter struct {
+	dst     io.Writer
+	level   int
+	workers int
+
+	// buf is the block currently being filled.
+	buf []byte
+
+	// dict is the end of the previous block.
+	dict []byte
+
+	// pending are the results of blocks being compressed, in order.
+	pending []chan parallelGzipBlock
+
+	crc    uint32
+	size   uint32
+	header bool
+	err    error
+}
+
+// parallelGzipBlock is the result of compressing a block.
+type parallelGzipBlock struct {
+	dat []byte
+	err error
+}
+
+func newParallelGzipWriter(dst io.Writer, level int, workers int) (*parallelGzipWriter, error) {
+	err := checkLevel("gzip", level)
+	if err != nil {
+		return nil, err
+	}
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &parallelGzipWriter{
+		dst:     dst,
+		level:   level,
+		workers: workers,
+	}, nil
+}
+
+func (z *parallelGzipWriter) Write(dat []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, dat)
+	z.size += uint32(len(dat))
+
+	var n int
+	for len(dat) > 0 {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, parallelGzipBlockSize)
+		}
+		c := copy(z.buf[len(z.buf):cap(z.buf)], dat)
+		z.buf = z.buf[:len(z.buf)+c]
+		dat = dat[c:]
+		n += c
+
+		if len(z.buf) == cap(z.buf) {
+			err := z.dispatch(false)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// dispatch starts compressing the current block.
+// If the maximum number of blocks are already in progress, it first waits for the oldest one and writes it out.
+func (z *parallelGzipWriter) dispatch(final bool) error {
+	for len(z.pending) >= z.workers {
+		err := z.writeNext()
+		if err != nil {
+			return err
+		}
+	}
+
+	blk, dict := z.buf, z.dict
+	res := make(chan parallelGzipBlock, 1)
+	go func() {
+		var out bytes.Buffer
+		fw, err := flate.NewWriterDict(&out, z.level, dict)
+		if err != nil {
+			res <- parallelGzipBlock{err: err}
+			return
+		}
+		_, err = fw.Write(blk)
+		if err == nil {
+			if final {
+				err = fw.Close()
+			} else {
+				err = fw.Flush()
+			}
+		}
+		res <- parallelGzipBlock{out.Bytes(), err}
+	}()
+	z.pending = append(z.pending, res)
+
+	// keep the end of the block as the dictionary for the next block
+	if len(blk) >= parallelGzipDictSize {
+		z.dict = blk[len(blk)-parallelGzipDictSize:]
+	} else {
+		z.dict = append(append([]byte(nil), dict...), blk...)
+		if len(z.dict) > parallelGzipDictSize {
+			z.dict = z.dict[len(z.dict)-parallelGzipDictSize:]
+		}
+	}
+	z.buf = nil
+
+	return nil
+}
+
+// writeNext waits for the oldest block to finish compressing and writes it out.
+func (z *parallelGzipWriter) writeNext() error {
+	res := <-z.pending[0]
+	z.pending[0] = nil
+	z.pending = z.pending[1:]
+	if res.err != nil {
+		z.err = res.err
+		return res.err
+	}
+
+	if !z.header {
+		_, err := z.dst.Write(gzipHeader)
+		if err != nil {
+			z.err = err
+			return err
+		}
+		z.header = true
+	}
+
+	_, err := z.dst.Write(res.dat)
+	if err != nil {
+		z.err = err
+	}
+	return err
+}
+
+// drain writes out all blocks in progress.
+func (z *parallelGzipWriter) drain() error {
+	for len(z.pending) > 0 {
+		err := z.writeNext()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush compresses and writes out all buffered data.
+func (z *parallelGzipWriter) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+	if len(z.buf) > 0 {
+		err := z.dispatch(false)
+		if err != nil {
+			return err
+		}
+	}
+	return z.drain()
+}
+
+// Close writes out the final block and the gzip trailer.
+// It does not close the destination.
+func (z *parallelGzipWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	err := z.dispatch(true)
+	if err != nil {
+		return err
+	}
+	err = z.drain()
+	if err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err = z.dst.Write(trailer[:])
+	if err != nil {
+		z.err = err
+		return err
+	}
+	z.err = errors.New("gzip writer closed")
+
+	return nil
+}
@@ -9,12 +9,94 @@ type streamHeader struct {
 
 	// Compression is the compression algorithm to use.
 	Compression string `json:"compression,omitempty"`
+
+	// Checksum is the checksum algorithm used to protect chunks of file data.
+	// The only supported algorithm is "crc32".
+	Checksum string `json:"checksum,omitempty"`
+
+	// Framing is the encoding of chunk lengths and checksums.
+	// The default is null-terminated decimal, and "varint" selects unsigned binary varints.
+	Framing string `json:"framing,omitempty"`
+
+	// Encryption describes the encryption of the stream, if it is encrypted.
+	Encryption *encryptionHeader `json:"encryption,omitempty"`
+
+	// Sparse is whether file bodies may contain holes.
+	Sparse bool `json:"sparse,omitempty"`
+
+	// Metadata is application-specific information about the stream.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Index is whether the terminator is followed by an index of the stream.
+	Index bool `json:"index,omitempty"`
+
+	// Manifest is whether the first entry of the stream is a manifest of the files in it.
+	Manifest bool `json:"manifest,omitempty"`
+}
+
+// encryptionHeader describes the encryption of a stream.
+type encryptionHeader struct {
+	// Algorithm is the encryption algorithm.
+	// The only supported algorithm is "aes-256-gcm".
+	Algorithm string `json:"algorithm"`
+
+	// Salt is the salt used to derive the key from a passphrase.
+	// This is omitted if a raw key was used.
+	Salt []byte `json:"salt,omitempty"`
+
+	// Iterations is the number of PBKDF2 iterations used to derive the key from a passphrase.
+	Iterations int `json:"iterations,omitempty"`
+
+	// Nonce is the random prefix of the nonce of each segment.
+	Nonce []byte `json:"nonce"`
+
+	// KeyCheck is an authentication tag used to check that the reader has the correct key.
+	KeyCheck []byte `json:"keycheck"`
+}
+
+const (
+	// fmtVersion is the latest supported version of the filestream format.
+	fmtVersion = 7
+
+	// checksumVersion is the format version which introduced chunk checksums.
+	checksumVersion = 1
+
+	// perFileCompressionVersion is the format version which introduced per-file compression.
+	perFileCompressionVersion = 2
+
+	// varintFramingVersion is the format version which introduced varint framing.
+	varintFramingVersion = 3
+
+	// encryptionVersion is the format version which introduced encryption.
+	encryptionVersion = 4
+
+	// sparseVersion is the format version which introduced holes in sparse files.
+	sparseVersion = 5
+
+	// indexVersion is the format version which introduced stream indexes.
+	indexVersion = 6
+
+	// compactTerminatorVersion is the format version which introduced the compact terminator, an empty header.
+	compactTerminatorVersion = 7
+)
+
+// holeChunk is a reserved chunk length which marks a hole in a sparse file.
+// It is followed by the length of the hole, and has no data or checksum.
+const holeChunk = 1<<63 - 1
+
+// require raises the version of the stream to at least the given version.
+func (hdr *streamHeader) require(version int) {
+	if hdr.Version < version {
+		hdr.Version = version
+	}
 }
 
 // fileHeader is a header which comes before a file
 type fileHeader struct {
 	// Path is the path relative to the base of the stream.
+	// Paths are always separated with "/" within the stream, regardless of the platform which wrote them.
 	// The path "\x00" terminates the file stream.
+	// From format v7, an empty header (a lone null byte) also terminates the file stream.
 	Path string `json:"path"`
 
 	// User is the username of the owner.
@@ -25,4 +107,52 @@ type fileHeader struct {
 
 	// Mode is the file permission mode code.
 	Mode os.FileMode `json:"mode,omitempty"`
+
+	// ExactMode indicates that the permission bits of Mode are explicitly 000, rather than missing.
+	ExactMode bool `json:"exactmode,omitempty"`
+
+	// HardlinkTo is the path of a previously streamed file which this entry is a hard link to.
+	// Hard link entries have no body.
+	HardlinkTo string `json:"hardlink,omitempty"`
+
+	// Size is the expected size of the file body, if known ahead of time.
+	// This is only a hint, and may not match the actual body.
+	Size *int64 `json:"size,omitempty"`
+
+	// Compression is the compression algorithm applied to the body of this file.
+	Compression string `json:"compression,omitempty"`
+
+	// Xattrs are the extended attributes of the file.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+
+	// Major is the major device number of a device node.
+	Major uint32 `json:"major,omitempty"`
+
+	// Minor is the minor device number of a device node.
+	Minor uint32 `json:"minor,omitempty"`
+
+	// Extra is application-specific metadata.
+	Extra map[string]string `json:"extra,omitempty"`
+
+	// ContentType is the MIME type of the file body.
+	ContentType string `json:"contenttype,omitempty"`
+}
+
+// streamIndex is the index which follows the terminator of an indexed stream.
+// It is encoded in the same way as a header, and is followed by the offset of the index as a fixed-width big-endian integer.
+type streamIndex struct {
+	// Files are the entries of the stream, in order.
+	Files []indexEntry `json:"files"`
 }
+
+// indexEntry is the location of an entry in an indexed stream.
+type indexEntry struct {
+	// Path is the path of the entry.
+	Path string `json:"path"`
+
+	// Offset is the offset of the file header from the start of the stream.
+	Offset int64 `json:"offset"`
+}
+
+// indexFooterSize is the size of the offset which ends an indexed stream.
+const indexFooterSize = 8
@@ -0,0 +1,122 @@
+package filestream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// IndexedReader opens files directly from an indexed stream, without reading the files before them.
+// Indexed streams are created with StreamOptions.Index, and cannot be compressed or encrypted.
+type IndexedReader struct {
+	src     io.ReadSeeker
+	hdr     streamHeader
+	offsets map[string]int64
+}
+
+// OpenIndexed opens an indexed stream for random access.
+// The index is loaded from the end of the stream.
+func OpenIndexed(rs io.ReadSeeker) (*IndexedReader, error) {
+	// read the stream header
+	_, err := rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(rs)
+	if err != nil {
+		return nil, err
+	}
+	if !r.hdr.Index {
+		return nil, errors.New("stream is not indexed")
+	}
+
+	// find the index
+	end, err := rs.Seek(-indexFooterSize, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find index: %w", err)
+	}
+	var footer [indexFooterSize]byte
+	_, err = io.ReadFull(rs, footer[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to find index: %w", err)
+	}
+	off := binary.BigEndian.Uint64(footer[:])
+	if off >= uint64(end) {
+		return nil, fmt.Errorf("index offset %d out of range", off)
+	}
+
+	// read the index
+	_, err = rs.Seek(int64(off), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	jd, err := bufio.NewReader(io.LimitReader(rs, end-int64(off))).ReadString('\x00')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	var idx streamIndex
+	err = json.Unmarshal([]byte(jd[:len(jd)-1]), &idx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	// later entries replace earlier ones with the same path, as they would when decoding
+	offsets := make(map[string]int64, len(idx.Files))
+	for _, e := range idx.Files {
+		offsets[e.Path] = e.Offset
+	}
+
+	return &IndexedReader{
+		src:     rs,
+		hdr:     r.hdr,
+		offsets: offsets,
+	}, nil
+}
+
+// Open opens the entry at the given path.
+// If there is no such entry, the error satisfies errors.Is(err, os.ErrNotExist).
+// The FileReader reads from the same source as the IndexedReader, so it is only valid until the next call to Open.
+func (ir *IndexedReader) Open(path string) (*FileReader, error) {
+	off, ok := ir.offsets[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	_, err := ir.src.Seek(off, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// start a reader at the file header, continuing the offsets of the stream
+	count := &countingReader{r: ir.src, n: off}
+	src := bufio.NewReader(count)
+	r := &Reader{
+		hdr:       ir.hdr,
+		checksums: ir.hdr.Checksum != "",
+		varint:    ir.hdr.Framing == "varint",
+		ready:     true,
+		stream:    src,
+		src:       src,
+		srcCount:  count,
+		count:     count,
+
+		maxChunkSize: defaultMaxChunkSize,
+	}
+	if !r.Next() {
+		if r.Err() != nil {
+			return nil, fmt.Errorf("failed to open %q: %w", path, r.Err())
+		}
+		return nil, fmt.Errorf("index entry for %q points to the end of the stream", path)
+	}
+	if r.File().Path() != path {
+		return nil, fmt.Errorf("index entry for %q points to %q", path, r.File().Path())
+	}
+
+	return r.File(), nil
+}
@@ -0,0 +1,113 @@
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestOpenIndexed(t *testing.T) {
+	files := []struct {
+		Path, Data string
+	}{
+		{"first.txt", "the first file"},
+		{"second.txt", "the second file"},
+		{"third.txt", "the third file"},
+	}
+
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Index: true, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		fw, err := w.File(f.Path, filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(f.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	// the index is skipped when reading sequentially
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := map[string]int64{}
+	for r.Next() {
+		offsets[r.File().Path()] = r.File().Offset()
+		_, err = ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ir, err := filestream.OpenIndexed(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{2, 0, 1, 2} {
+		f := files[i]
+		fr, err := ir.Open(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != f.Data {
+			t.Errorf("expected %q in %q but got %q", f.Data, f.Path, data)
+		}
+		if fr.Offset() != offsets[f.Path] {
+			t.Errorf("expected offset %d for %q but got %d", offsets[f.Path], f.Path, fr.Offset())
+		}
+	}
+	fr, err := ir.Open("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsDir() {
+		t.Error("expected a directory")
+	}
+	if _, err := ir.Open("missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist but got %v", err)
+	}
+
+	// indexes require offsets in the stored stream
+	_, err = filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{Index: true, Compression: "gzip"})
+	if err == nil {
+		t.Error("created an indexed compressed stream")
+	}
+	plain, err := filestream.EncodeToBytes(map[string][]byte{"file.txt": []byte("data")}, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = filestream.OpenIndexed(bytes.NewReader(plain))
+	if err == nil {
+		t.Error("opened a stream without an index")
+	}
+}
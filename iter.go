@@ -0,0 +1,23 @@
+//go:build go1.23
+// +build go1.23
+
+package filestream
+
+import "iter"
+
+// Files returns an iterator over the files in the stream.
+// Each file is yielded with a nil error, and must be read or skipped before the loop continues, as with Next.
+// If reading the stream fails, the error is yielded with a nil file and the iteration stops.
+// Breaking out of the loop early leaves the rest of the stream unread.
+func (r *Reader) Files() iter.Seq2[*FileReader, error] {
+	return func(yield func(*FileReader, error) bool) {
+		for r.Next() {
+			if !yield(r.File(), nil) {
+				return
+			}
+		}
+		if err := r.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build go1.23
+// +build go1.23
+
+package filestream_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestFiles(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a.txt", "b.txt", "c.txt"} {
+		err = w.WriteFile(path, []byte(path), filestream.FileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := buf.Bytes()
+
+	// iterate over all files
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for fr, err := range r.Files() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != fr.Path() {
+			t.Errorf("expected %q but got %q", fr.Path(), string(body))
+		}
+		paths = append(paths, fr.Path())
+	}
+	if diff := cmp.Diff([]string{"a.txt", "b.txt", "c.txt"}, paths); diff != "" {
+		t.Errorf("unexpected paths (-want +got):\n%s", diff)
+	}
+
+	// break out early
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for range r.Files() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("expected 1 iteration but got %d", n)
+	}
+
+	// errors end the iteration
+	r, err = filestream.NewReader(bytes.NewReader(dat[:len(dat)-4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	n = 0
+	for fr, err := range r.Files() {
+		n++
+		if err != nil {
+			if fr != nil {
+				t.Error("file yielded with error")
+			}
+			errs = append(errs, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 4 || len(errs) != 1 {
+		t.Errorf("expected 3 files and an error but got %d iterations with errors %v", n, errs)
+	}
+}
@@ -0,0 +1,108 @@
+package filestream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// manifestPath is the reserved path of the manifest entry.
+const manifestPath = ".filestream-manifest"
+
+// Manifest is a list of the files in a stream, which is sent before the files themselves.
+type Manifest struct {
+	// Files are the regular files which the stream contains.
+	Files []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes a file in a Manifest.
+type ManifestEntry struct {
+	// Path is the path of the file within the stream.
+	Path string `json:"path"`
+
+	// Size is the size of the body of the file, in bytes.
+	Size int64 `json:"size"`
+}
+
+// TotalSize returns the sum of the sizes of the files in the manifest.
+func (m *Manifest) TotalSize() int64 {
+	var total int64
+	for _, e := range m.Files {
+		total += e.Size
+	}
+	return total
+}
+
+// BuildManifest creates a manifest of the files which EncodeFiles would encode from the given path.
+// Hard links are not included, since their bodies are not sent.
+// The manifest is only accurate if the files are not modified before they are encoded.
+func BuildManifest(path string, opts EncodeOptions) (*Manifest, error) {
+	m := &Manifest{Files: []ManifestEntry{}}
+	err := walkFiles(context.Background(), []string{path}, opts, func(rawpath string, info os.FileInfo, hdr fileHeader) error {
+		if info.Mode().IsRegular() && hdr.HardlinkTo == "" {
+			m.Files = append(m.Files, ManifestEntry{Path: hdr.Path, Size: *hdr.Size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeManifest writes the manifest entry at the start of the stream.
+// It is not reported to the Progress or FileDone callbacks.
+func (w *Writer) writeManifest(m *Manifest) error {
+	dat, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	progress, fileDone := w.progress, w.fileDone
+	w.progress, w.fileDone = nil, nil
+	defer func() { w.progress, w.fileDone = progress, fileDone }()
+
+	err = w.WriteFile(manifestPath, dat, FileOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Manifest returns the manifest of the stream, or nil if the stream does not have one.
+func (r *Reader) Manifest() *Manifest {
+	return r.manifest
+}
+
+// readManifest reads the manifest entry at the start of the stream.
+func (r *Reader) readManifest() error {
+	// the manifest is never returned in raw form
+	raw := r.raw
+	r.raw = false
+	defer func() { r.raw = raw }()
+
+	if !r.next() {
+		err := r.err
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if r.fr.Path() != manifestPath {
+		return fmt.Errorf("failed to read manifest: unexpected entry %q", r.fr.Path())
+	}
+	dat, err := ioutil.ReadAll(r.fr)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	err = json.Unmarshal(dat, &m)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	r.manifest, r.fr = &m, nil
+	return nil
+}
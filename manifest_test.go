@@ -0,0 +1,118 @@
+package filestream_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestManifest(t *testing.T) {
+	src, err := ioutil.TempDir("", "filestream-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	err = os.Mkdir(filepath.Join(src, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.txt": bytes.Repeat([]byte("b"), 100000),
+		"empty.txt": nil,
+	}
+	for path, dat := range files {
+		err = ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(path)), dat, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := filestream.BuildManifest(src, filestream.EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: "gzip", Manifest: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.EncodeFiles(w, src, filestream.EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the manifest is available before any files are read
+	r, err := filestream.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Manifest()
+	if got == nil {
+		t.Fatal("stream has no manifest")
+	}
+	if got.TotalSize() != 100005 {
+		t.Errorf("expected a total size of %d but got %d", 100005, got.TotalSize())
+	}
+
+	// the manifest matches the files in the stream, and is not returned as a file itself
+	var actual []filestream.ManifestEntry
+	for r.Next() {
+		fr := r.File()
+		if !fr.Opts().Permissions.IsRegular() {
+			continue
+		}
+		dat, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual = append(actual, filestream.ManifestEntry{Path: fr.Path(), Size: int64(len(dat))})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(actual, got.Files); diff != "" {
+		t.Errorf("manifest does not match files (-actual +manifest):\n%s", diff)
+	}
+
+	// the manifest is not extracted
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	r, err = filestream.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{Base: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Lstat(filepath.Join(dst, ".filestream-manifest"))
+	if !os.IsNotExist(err) {
+		t.Errorf("manifest was extracted: %v", err)
+	}
+
+	// streams without a manifest return nil
+	dat, err := filestream.EncodeToBytes(files, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Manifest() != nil {
+		t.Error("unexpected manifest")
+	}
+}
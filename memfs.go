@@ -0,0 +1,245 @@
+// +build go1.16
+
+package filestream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Load reads an entire stream into memory, and returns it as a read-only filesystem.
+// Paths in the stream are made relative to the root of the filesystem, and missing parent directories are created implicitly.
+// The returned filesystem also implements fs.ReadDirFS and fs.StatFS.
+func Load(src io.Reader) (fs.FS, error) {
+	r, err := NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := &memFS{
+		root: &memNode{
+			name:     ".",
+			mode:     fs.ModeDir | 0755,
+			children: map[string]*memNode{},
+		},
+	}
+	for r.Next() {
+		fr := r.File()
+		name := memPath(fr.Path())
+
+		var node *memNode
+		switch {
+		case fr.IsDir():
+			node = fsys.mkdirAll(name)
+			if node == nil {
+				return nil, &fs.PathError{Op: "load", Path: name, Err: errors.New("parent is not a directory")}
+			}
+			node.mode = fr.Opts().Permissions
+			continue
+		case fr.HardlinkTo() != "":
+			target, err := fsys.lookup(memPath(fr.HardlinkTo()))
+			if err != nil {
+				return nil, err
+			}
+			node = &memNode{
+				mode: target.mode,
+				data: target.data,
+			}
+		default:
+			data, err := ioutil.ReadAll(fr)
+			if err != nil {
+				return nil, err
+			}
+			node = &memNode{
+				mode: fr.Opts().Permissions,
+				data: data,
+			}
+		}
+
+		if name == "." {
+			return nil, &fs.PathError{Op: "load", Path: fr.Path(), Err: errors.New("file at root of stream")}
+		}
+		parent := fsys.mkdirAll(path.Dir(name))
+		if parent == nil {
+			return nil, &fs.PathError{Op: "load", Path: name, Err: errors.New("parent is not a directory")}
+		}
+		node.name = path.Base(name)
+		parent.children[node.name] = node
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// memPath converts a path in a stream to a path in a memFS.
+func memPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// memFS is an in-memory read-only filesystem.
+type memFS struct {
+	root *memNode
+}
+
+// memNode is a file or directory in a memFS.
+type memNode struct {
+	name     string
+	mode     fs.FileMode
+	data     []byte
+	children map[string]*memNode
+}
+
+// mkdirAll looks up a directory, creating it and any parents if they do not exist.
+// If a path component is not a directory, this returns nil.
+func (fsys *memFS) mkdirAll(name string) *memNode {
+	node := fsys.root
+	if name == "." {
+		return node
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if node.children == nil {
+			return nil
+		}
+		child, ok := node.children[elem]
+		if !ok {
+			child = &memNode{
+				name:     elem,
+				mode:     fs.ModeDir | 0755,
+				children: map[string]*memNode{},
+			}
+			node.children[elem] = child
+		}
+		node = child
+	}
+	if node.children == nil {
+		return nil
+	}
+	return node
+}
+
+// lookup finds the node with the given name.
+func (fsys *memFS) lookup(name string) (*memNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	node := fsys.root
+	if name == "." {
+		return node, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		child, ok := node.children[elem]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (fsys *memFS) Open(name string) (fs.File, error) {
+	node, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if node.children != nil {
+		return &memDir{node: node, entries: node.entries()}, nil
+	}
+	return &memFile{node: node, Reader: bytes.NewReader(node.data)}, nil
+}
+
+func (fsys *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if node.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return node.entries(), nil
+}
+
+func (fsys *memFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return memInfo{node}, nil
+}
+
+// entries returns the sorted entries of a directory node.
+func (node *memNode) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(node.children))
+	for _, child := range node.children {
+		entries = append(entries, memInfo{child})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// memInfo is the fs.FileInfo and fs.DirEntry of a memNode.
+type memInfo struct {
+	node *memNode
+}
+
+func (mi memInfo) Name() string               { return mi.node.name }
+func (mi memInfo) Size() int64                { return int64(len(mi.node.data)) }
+func (mi memInfo) Mode() fs.FileMode          { return mi.node.mode }
+func (mi memInfo) Type() fs.FileMode          { return mi.node.mode.Type() }
+func (mi memInfo) ModTime() time.Time         { return time.Time{} }
+func (mi memInfo) IsDir() bool                { return mi.node.mode.IsDir() }
+func (mi memInfo) Sys() interface{}           { return nil }
+func (mi memInfo) Info() (fs.FileInfo, error) { return mi, nil }
+
+// memFile is an open regular file in a memFS.
+type memFile struct {
+	node *memNode
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return memInfo{f.node}, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is an open directory in a memFS.
+type memDir struct {
+	node    *memNode
+	entries []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return memInfo{d.node}, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,76 @@
+// +build go1.16
+
+package filestream_test
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestLoad(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory(".", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{Permissions: 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		Path, Data string
+	}{
+		{"hello.txt", "hello world"},
+		{"dir/a.txt", "a"},
+		{"implicit/b.txt", "b"},
+	} {
+		fw, err := w.File(f.Path, filestream.FileOptions{Permissions: 0644})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(f.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := filestream.Load(&buf)
+	if err != nil {
+		t.Fatalf("failed to load stream: %s", err)
+	}
+	err = fstest.TestFS(fsys, "hello.txt", "dir/a.txt", "implicit/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat, err := fs.ReadFile(fsys, "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dat) != "hello world" {
+		t.Errorf("expected %q but got %q", "hello world", string(dat))
+	}
+	info, err := fs.Stat(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != fs.ModeDir|0750 {
+		t.Errorf("expected mode %v but got %v", fs.ModeDir|0750, info.Mode())
+	}
+}
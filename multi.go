@@ -0,0 +1,62 @@
+package filestream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// NewMultiWriter creates a new file stream writer which writes the same stream to all of the destinations.
+// A failed destination is handled according to opts.OnDestinationError.
+func NewMultiWriter(dsts []io.Writer, opts StreamOptions) (*Writer, error) {
+	if len(dsts) == 0 {
+		return nil, errors.New("no destinations")
+	}
+
+	return NewWriter(&multiDest{
+		dsts:  append([]io.Writer(nil), dsts...),
+		live:  len(dsts),
+		onErr: opts.OnDestinationError,
+	}, opts)
+}
+
+// multiDest is an io.Writer which duplicates writes to multiple destinations.
+type multiDest struct {
+	// dsts are the destinations
+	// failed destinations are replaced with nil
+	dsts []io.Writer
+
+	// live is the number of destinations which have not failed
+	live int
+
+	// onErr is the optional callback used to decide whether to continue after a failure
+	onErr func(int, error) bool
+}
+
+func (m *multiDest) Write(dat []byte) (int, error) {
+	for i, dst := range m.dsts {
+		if dst == nil {
+			continue
+		}
+
+		n, err := dst.Write(dat)
+		if err == nil && n < len(dat) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			if m.onErr == nil || !m.onErr(i, err) {
+				return 0, fmt.Errorf("destination %d: %w", i, err)
+			}
+
+			// drop failed destination
+			m.dsts[i] = nil
+			m.live--
+		}
+	}
+
+	if m.live == 0 {
+		return 0, errors.New("all destinations failed")
+	}
+
+	return len(dat), nil
+}
@@ -0,0 +1,104 @@
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+// failingWriter is an io.Writer which fails after a number of bytes have been written.
+type failingWriter struct {
+	rem int
+}
+
+func (fw *failingWriter) Write(dat []byte) (int, error) {
+	if len(dat) > fw.rem {
+		n := fw.rem
+		fw.rem = 0
+		return n, errors.New("destination failed")
+	}
+	fw.rem -= len(dat)
+	return len(dat), nil
+}
+
+// writeMultiStream writes a stream large enough to require multiple flushes.
+func writeMultiStream(w *filestream.Writer) error {
+	fw, err := w.File("big.txt", filestream.FileOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(bytes.Repeat([]byte("data"), 4096))
+	if err != nil {
+		return err
+	}
+	err = fw.Close()
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestMultiWriterAbort(t *testing.T) {
+	var good bytes.Buffer
+	w, err := filestream.NewMultiWriter([]io.Writer{&good, &failingWriter{rem: 100}}, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeMultiStream(w); err == nil {
+		t.Fatal("expected stream to be aborted")
+	}
+}
+
+func TestMultiWriterSurvivors(t *testing.T) {
+	var good bytes.Buffer
+	var failed []int
+	w, err := filestream.NewMultiWriter([]io.Writer{&failingWriter{rem: 100}, &good}, filestream.StreamOptions{
+		OnDestinationError: func(i int, err error) bool {
+			failed = append(failed, i)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeMultiStream(w); err != nil {
+		t.Fatalf("failed to write stream: %s", err)
+	}
+	if len(failed) != 1 || failed[0] != 0 {
+		t.Errorf("expected destination 0 to fail but got %v", failed)
+	}
+
+	// the surviving destination should have a complete stream
+	r, err := filestream.NewReader(&good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		dat, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dat) != 4*4096 {
+			t.Errorf("expected %d bytes but got %d", 4*4096, len(dat))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("failed to read surviving stream: %s", err)
+	}
+}
+
+func TestMultiWriterAllFailed(t *testing.T) {
+	w, err := filestream.NewMultiWriter([]io.Writer{&failingWriter{rem: 100}}, filestream.StreamOptions{
+		OnDestinationError: func(i int, err error) bool { return true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeMultiStream(w); err == nil {
+		t.Fatal("expected stream to fail once all destinations failed")
+	}
+}
@@ -0,0 +1,145 @@
+package filestream
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Mux allows multiple goroutines to write files into the same stream.
+// A Writer can only write one file at a time, so each file holds an exclusive lock on the stream from when it is opened until it is closed.
+// Other producers block until the lock is released, and can then continue with their own files.
+// Throughput is still bounded by the single output stream, so producers should prepare their data before opening a file, and keep files open only while writing them.
+type Mux struct {
+	mu     sync.Mutex
+	w      *Writer
+	closed bool
+}
+
+// NewMux creates a Mux which writes files to the given Writer.
+// The Writer must not be used directly while the Mux is in use.
+func NewMux(w *Writer) *Mux {
+	return &Mux{w: w}
+}
+
+// errMuxClosed is returned when using a Mux after it has been closed.
+var errMuxClosed = errors.New("mux closed")
+
+// lock acquires the stream, failing if the Mux has been closed.
+func (m *Mux) lock() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errMuxClosed
+	}
+	return nil
+}
+
+// File opens a file in the stream, as with Writer.File.
+// The stream is locked until the file is closed, so the file must always be closed, even if a write fails.
+func (m *Mux) File(path string, opts FileOptions) (io.WriteCloser, error) {
+	err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	fw, err := m.w.File(path, opts)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	return &muxFile{m: m, w: fw}, nil
+}
+
+// FileN opens a file with a declared size in the stream, as with Writer.FileN.
+// The stream is locked until the file is closed, so the file must always be closed, even if a write fails.
+func (m *Mux) FileN(path string, size int64, opts FileOptions) (io.WriteCloser, error) {
+	err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	fw, err := m.w.FileN(path, size, opts)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	return &muxFile{m: m, w: fw}, nil
+}
+
+// WriteFile writes a complete file to the stream, as with Writer.WriteFile.
+func (m *Mux) WriteFile(path string, data []byte, opts FileOptions) error {
+	err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	return m.w.WriteFile(path, data, opts)
+}
+
+// Directory adds a directory to the stream, as with Writer.Directory.
+func (m *Mux) Directory(path string, opts FileOptions) error {
+	err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	return m.w.Directory(path, opts)
+}
+
+// Flush flushes the stream, as with Writer.Flush.
+// It waits for any open file to be closed first.
+func (m *Mux) Flush() error {
+	err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	return m.w.Flush()
+}
+
+// Close waits for any open file to be closed, and then closes the underlying Writer.
+// Producers which use the Mux afterwards receive an error.
+func (m *Mux) Close() error {
+	err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	m.closed = true
+	return m.w.Close()
+}
+
+// muxFile is a file opened through a Mux, which holds the lock on the stream until it is closed.
+type muxFile struct {
+	m    *Mux
+	w    io.WriteCloser
+	done bool
+}
+
+func (mf *muxFile) Write(dat []byte) (int, error) {
+	if mf.done {
+		return 0, errors.New("writing to file that has already been closed")
+	}
+	return mf.w.Write(dat)
+}
+
+// ReadFrom copies data into the file, using the ReadFrom implementation of the underlying file.
+func (mf *muxFile) ReadFrom(src io.Reader) (int64, error) {
+	if mf.done {
+		return 0, errors.New("writing to file that has already been closed")
+	}
+	return io.Copy(mf.w, src)
+}
+
+func (mf *muxFile) Close() error {
+	if mf.done {
+		return errors.New("file already closed")
+	}
+	mf.done = true
+	defer mf.m.mu.Unlock()
+
+	return mf.w.Close()
+}
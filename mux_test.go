@@ -0,0 +1,100 @@
+package filestream_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestMux(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := filestream.NewMux(w)
+
+	// each producer writes files in several pieces, so that interleaving would corrupt them
+	const producers, files = 8, 16
+	var wg sync.WaitGroup
+	errs := make(chan error, producers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < files; i++ {
+				path := fmt.Sprintf("p%d/f%d.txt", p, i)
+				if i%2 == 0 {
+					err := m.WriteFile(path, []byte(strings.Repeat(path, 4)), filestream.FileOptions{})
+					if err != nil {
+						errs <- err
+						return
+					}
+					continue
+				}
+				fw, err := m.File(path, filestream.FileOptions{})
+				if err != nil {
+					errs <- err
+					return
+				}
+				for j := 0; j < 4; j++ {
+					_, err = fw.Write([]byte(path))
+					if err != nil {
+						fw.Close()
+						errs <- err
+						return
+					}
+				}
+				err = fw.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.WriteFile("late.txt", nil, filestream.FileOptions{})
+	if err == nil {
+		t.Error("wrote file after closing mux")
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for r.Next() {
+		path := r.File().Path()
+		dat, err := ioutil.ReadAll(r.File())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != strings.Repeat(path, 4) {
+			t.Errorf("file %q has corrupted contents %q", path, dat)
+		}
+		if seen[path] {
+			t.Errorf("duplicate file %q", path)
+		}
+		seen[path] = true
+	}
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+	if len(seen) != producers*files {
+		t.Errorf("expected %d files but got %d", producers*files, len(seen))
+	}
+}
@@ -19,89 +19,233 @@ type testFile struct {
 	Opts filestream.FileOptions
 }
 
-func TestRoundTrip(t *testing.T) {
-	tbl := []struct {
-		StreamOpts filestream.StreamOptions
-		Files      []testFile
-	}{
-		{
-			Files: []testFile{
-				testFile{
-					Path: "/",
-					Dir:  true,
-				},
-				testFile{
-					Path: "/hello.txt",
-					Data: "hello world",
-				},
+// roundTripTests are streams which are written and then read back by TestRoundTrip.
+var roundTripTests = []struct {
+	StreamOpts filestream.StreamOptions
+	Files      []testFile
+}{
+	{
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
 			},
 		},
-		{
-			Files: []testFile{
-				testFile{
-					Path: "/",
-					Dir:  true,
+	},
+	{
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+				Opts: filestream.FileOptions{
+					User:        "usr",
+					Group:       "grp",
+					Permissions: 0644,
 				},
-				testFile{
-					Path: "/hello.txt",
-					Data: "hello world",
-					Opts: filestream.FileOptions{
-						User:        "usr",
-						Group:       "grp",
-						Permissions: 0644,
+			},
+		},
+	},
+	{
+		Files: []testFile{
+			testFile{
+				Path: "/data.json",
+				Data: `{"hello":"world"}`,
+				Opts: filestream.FileOptions{
+					Extra: map[string]string{
+						"content-type": "application/json",
+						"sha256":       "93a23971a914e5eacbf0a8d25154cda309c3c1c72fbb9914d47c60f3cb681588",
+						"":             "empty key",
+						"unicode ☺":    "\x00 and \"quotes\"",
 					},
 				},
 			},
 		},
-		{
-			StreamOpts: filestream.StreamOptions{
-				Compression: "gzip",
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Compression: "gzip",
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
 			},
-			Files: []testFile{
-				testFile{
-					Path: "/",
-					Dir:  true,
-				},
-				testFile{
-					Path: "/hello.txt",
-					Data: "hello world",
-				},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Compression:      "gzip",
+			CompressionLevel: 9,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Compression: "brotli",
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Compression:      "brotli",
+			CompressionLevel: 11,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Compression: "lz4",
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
 			},
 		},
-		{
-			StreamOpts: filestream.StreamOptions{
-				Compression:      "gzip",
-				CompressionLevel: 9,
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			Checksums: true,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			VarintFraming: true,
+			Checksums:     true,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+			},
+			testFile{
+				Path: "/empty.txt",
+			},
+		},
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			PerFileCompression: true,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/",
+				Dir:  true,
+			},
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
+				Opts: filestream.FileOptions{
+					Compression: "gzip",
+				},
+			},
+			testFile{
+				Path: "/stored.txt",
+				Data: "not compressed",
 			},
-			Files: []testFile{
-				testFile{
-					Path: "/",
-					Dir:  true,
+			testFile{
+				Path: "/hello.lz4",
+				Data: "hello world",
+				Opts: filestream.FileOptions{
+					Compression: "lz4",
 				},
-				testFile{
-					Path: "/hello.txt",
-					Data: "hello world",
+			},
+			testFile{
+				Path: "/hello.br",
+				Data: "hello world",
+				Opts: filestream.FileOptions{
+					Compression: "brotli",
 				},
 			},
 		},
-		{
-			StreamOpts: filestream.StreamOptions{
-				Compression: "lz4",
+	},
+	{
+		StreamOpts: filestream.StreamOptions{
+			ChunkSize:          4,
+			Checksums:          true,
+			PerFileCompression: true,
+		},
+		Files: []testFile{
+			testFile{
+				Path: "/hello.txt",
+				Data: "hello world",
 			},
-			Files: []testFile{
-				testFile{
-					Path: "/",
-					Dir:  true,
-				},
-				testFile{
-					Path: "/hello.txt",
-					Data: "hello world",
+			testFile{
+				Path: "/exact.txt",
+				Data: "12345678",
+			},
+			testFile{
+				Path: "/hello.gz",
+				Data: "hello world",
+				Opts: filestream.FileOptions{
+					Compression: "gzip",
 				},
 			},
 		},
-	}
-	for _, c := range tbl {
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range roundTripTests {
 		var wg sync.WaitGroup
+		var wstats filestream.Stats
 		pr, pw := io.Pipe()
 		defer pr.Close()
 		wg.Add(1)
@@ -152,6 +296,7 @@ func TestRoundTrip(t *testing.T) {
 				pw.CloseWithError(err)
 				return
 			}
+			wstats = w.Stats()
 		}()
 		r, err := filestream.NewReader(pr)
 		if err != nil {
@@ -181,5 +326,20 @@ func TestRoundTrip(t *testing.T) {
 		if diff := cmp.Diff(c.Files, res); diff != "" {
 			t.Errorf("data corrupted through stream: (-in +out): %s\n", diff)
 		}
+
+		// both ends should agree on the totals
+		var body int64
+		for _, f := range c.Files {
+			body += int64(len(f.Data))
+		}
+		if wstats.Files != int64(len(c.Files)) || wstats.BodyBytes != body {
+			t.Errorf("expected %d files with %d bytes but writer reported %+v", len(c.Files), body, wstats)
+		}
+		if wstats.HeaderBytes == 0 || wstats.StreamBytes == 0 {
+			t.Errorf("missing writer totals: %+v", wstats)
+		}
+		if diff := cmp.Diff(wstats, r.Stats()); diff != "" {
+			t.Errorf("reader and writer stats differ: (-writer +reader): %s\n", diff)
+		}
 	}
 }
@@ -0,0 +1,130 @@
+package filestream
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the granularity at which zero runs are detected and recreated.
+const sparseBlockSize = 4096
+
+// zeroBlock is a block of zeros for filling holes.
+var zeroBlock [sparseBlockSize]byte
+
+// isZero checks whether a block of data is all zeros.
+func isZero(dat []byte) bool {
+	for _, b := range dat {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseCopy copies a file body into a file stream, encoding zero blocks as holes.
+func sparseCopy(fw *fileWriter, src io.Reader, buf []byte) error {
+	var hole int64
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		dat := buf[:n]
+
+		// start is the start of the data which has not yet been written
+		var start int
+		for i := 0; i < len(dat); i += sparseBlockSize {
+			end := i + sparseBlockSize
+			if end > len(dat) {
+				end = len(dat)
+			}
+			if !isZero(dat[i:end]) {
+				continue
+			}
+
+			// write out the data before this block
+			if start < i {
+				err := sparseWrite(fw, hole, dat[start:i])
+				if err != nil {
+					return err
+				}
+				hole = 0
+			}
+			hole += int64(end - i)
+			start = end
+		}
+		if start < len(dat) {
+			err := sparseWrite(fw, hole, dat[start:])
+			if err != nil {
+				return err
+			}
+			hole = 0
+		}
+
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			if hole > 0 {
+				return fw.hole(hole)
+			}
+			return nil
+		default:
+			return rerr
+		}
+	}
+}
+
+// sparseWrite writes a pending hole followed by data.
+func sparseWrite(fw *fileWriter, hole int64, dat []byte) error {
+	if hole > 0 {
+		err := fw.hole(hole)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fw.Write(dat)
+	return err
+}
+
+// sparseWriter writes to a file, seeking over zero blocks instead of writing them.
+// The file must be empty to start with, so that the skipped regions read as zeros.
+type sparseWriter struct {
+	f *os.File
+
+	// skipped is whether the last block was skipped, in which case the file must be extended to the full size.
+	skipped bool
+}
+
+func (sw *sparseWriter) Write(dat []byte) (int, error) {
+	var n int
+	for len(dat) > 0 {
+		blk := dat
+		if len(blk) > sparseBlockSize {
+			blk = blk[:sparseBlockSize]
+		}
+
+		if isZero(blk) {
+			_, err := sw.f.Seek(int64(len(blk)), io.SeekCurrent)
+			if err != nil {
+				return n, err
+			}
+			sw.skipped = true
+		} else {
+			wn, err := sw.f.Write(blk)
+			if err != nil {
+				return n + wn, err
+			}
+			sw.skipped = false
+		}
+
+		n += len(blk)
+		dat = dat[len(blk):]
+	}
+
+	return n, nil
+}
+
+// finish sets the size of the file, in case it ends with a hole.
+func (sw *sparseWriter) finish(size int64) error {
+	if !sw.skipped {
+		return nil
+	}
+	return sw.f.Truncate(size)
+}
@@ -0,0 +1,72 @@
+package filestream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// AppendStream copies the files of an encoded stream into this stream.
+// This allows pre-encoded fragments of a stream to be combined into a larger stream.
+// The metadata of the source stream is not copied, and the source is read to the end of its terminator.
+func (w *Writer) AppendStream(src io.Reader) error {
+	return w.AppendStreamAt(src, "")
+}
+
+// AppendStreamAt copies the files of an encoded stream into this stream, with each path (and hard link target) placed under the given prefix.
+// The entries are currently decoded and re-encoded, so file bodies are decompressed and framed again.
+// Per-file compression is kept if it is enabled for this stream, and holes in sparse files are written out as zeros.
+// This may be replaced by a raw copy where the framing of the streams is compatible.
+func (w *Writer) AppendStreamAt(src io.Reader, prefix string) error {
+	r, err := NewReader(src)
+	if err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	for r.Next() {
+		err = w.appendEntry(r.File(), prefix)
+		if err != nil {
+			return fmt.Errorf("failed to append %q: %w", r.File().Path(), err)
+		}
+	}
+	return r.Err()
+}
+
+// appendEntry re-encodes an entry of another stream into this stream.
+func (w *Writer) appendEntry(fr *FileReader, prefix string) error {
+	p, target := fr.Path(), fr.HardlinkTo()
+	if prefix != "" {
+		p = path.Join(prefix, p)
+		if target != "" {
+			target = path.Join(prefix, target)
+		}
+	}
+
+	opts := fr.Opts()
+	if !w.perFile {
+		opts.Compression = ""
+	}
+	mode := opts.Permissions
+	switch {
+	case target != "":
+		return w.Hardlink(p, target, opts)
+	case mode.IsDir():
+		return w.Directory(p, opts)
+	case mode&(os.ModeNamedPipe|os.ModeDevice) != 0:
+		major, minor := fr.Device()
+		return w.Special(p, major, minor, opts)
+	case !mode.IsRegular():
+		return errors.New("unsupported file type")
+	}
+
+	fw, err := w.File(p, opts)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, fr)
+	if err != nil {
+		return err
+	}
+	return fw.Close()
+}
@@ -0,0 +1,84 @@
+package filestream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// defaultSpoolThreshold is the default size above which spooled data is written to a temporary file.
+const defaultSpoolThreshold = 1 << 20
+
+// spool holds the data from a reader, so that its size is known before it is read back.
+// Data is kept in memory up to a threshold, and beyond that it is written to a temporary file.
+type spool struct {
+	buf  *bytes.Reader
+	file *os.File
+	size int64
+}
+
+// newSpool reads all data from src into a spool.
+// The temporary file (if needed) is created in dir, or the default temporary directory if dir is empty.
+// The spool must be closed to remove the temporary file.
+func newSpool(src io.Reader, threshold int64, dir string) (*spool, error) {
+	// read into memory up to the threshold
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(src, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= threshold {
+		return &spool{buf: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+
+	// spill to a temporary file
+	f, err := ioutil.TempFile(dir, "filestream-spool-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{file: f}
+	_, err = buf.WriteTo(f)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	m, err := io.Copy(f, src)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.size = n + m
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Size returns the total size of the spooled data.
+func (s *spool) Size() int64 {
+	return s.size
+}
+
+// Read reads back the spooled data.
+func (s *spool) Read(dst []byte) (int, error) {
+	if s.file != nil {
+		return s.file.Read(dst)
+	}
+	return s.buf.Read(dst)
+}
+
+// Close releases the spooled data, and removes the temporary file if there is one.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rerr := os.Remove(s.file.Name()); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -1,4 +1,4 @@
-// +build !linux,!darwin
+// +build !linux,!darwin,!windows
 
 package filestream
 
@@ -12,4 +12,16 @@ func getGroup(info os.FileInfo) (string, error) {
 	return "", nil
 }
 
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func getInode(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
 func chown(path string, fo FileOptions) error { return nil }
+
+func umask() os.FileMode { return 0 }
+
+const oNoFollow = 0
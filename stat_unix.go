@@ -27,6 +27,33 @@ func getGroup(info os.FileInfo) (string, error) {
 	return g.Name, nil
 }
 
+// getFileID gets the identity of a file which has multiple hard links.
+// If the file only has a single link, this returns false.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	st := info.Sys().(*syscall.Stat_t)
+	if st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// getInode gets the identity of a file, regardless of the number of links to it.
+func getInode(info os.FileInfo) (fileID, bool) {
+	st := info.Sys().(*syscall.Stat_t)
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// oNoFollow is the flag to open a file without following a symbolic link.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// umask gets the file mode creation mask of the process.
+// There is no way to read the mask without setting it, so it is briefly cleared and then restored.
+func umask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask) & os.ModePerm
+}
+
 var curUID, curGID = os.Getuid(), os.Getgid()
 
 func chown(path string, fo FileOptions) error {
@@ -55,3 +82,17 @@ func chown(path string, fo FileOptions) error {
 	}
 	return syscall.Chown(path, uid, gid)
 }
+
+// unixMode converts the type and permission bits of a FileMode to a unix mode for mknod.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		m |= syscall.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		m |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		m |= syscall.S_IFBLK
+	}
+	return m
+}
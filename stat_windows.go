@@ -0,0 +1,34 @@
+// +build windows
+
+package filestream
+
+import "os"
+
+// getUser is a no-op on Windows, which does not have unix file ownership.
+func getUser(info os.FileInfo) (string, error) {
+	return "", nil
+}
+
+// getGroup is a no-op on Windows, which does not have unix file ownership.
+func getGroup(info os.FileInfo) (string, error) {
+	return "", nil
+}
+
+// getFileID is not supported on Windows, so hard links are not detected.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// getInode is not supported on Windows, so files are compared with os.SameFile instead.
+func getInode(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// oNoFollow is not supported on Windows.
+const oNoFollow = 0
+
+// umask always returns 0 on Windows, which does not have a file mode creation mask.
+func umask() os.FileMode { return 0 }
+
+// chown is a no-op on Windows, which does not have unix file ownership.
+func chown(path string, fo FileOptions) error { return nil }
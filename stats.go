@@ -0,0 +1,31 @@
+package filestream
+
+import "io"
+
+// Stats are totals of the data transferred through a stream.
+type Stats struct {
+	// Files is the number of entries, including directories, links, and special files.
+	Files int64
+
+	// BodyBytes is the total size of file bodies, before compression and framing.
+	BodyBytes int64
+
+	// HeaderBytes is the total size of the encoded stream and file headers, including the terminating header.
+	HeaderBytes int64
+
+	// StreamBytes is the total amount of data transferred to or from the underlying writer or reader.
+	// This is after compression and encryption, so it may be compared with BodyBytes to find the compression ratio.
+	StreamBytes int64
+}
+
+// countingWriter is an io.Writer which counts the data written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(dat []byte) (int, error) {
+	n, err := cw.w.Write(dat)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,221 @@
+package filestream
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// TarOptions are options for converting between tar archives and file streams.
+type TarOptions struct {
+	// SkipUnsupported is whether to skip entries which cannot be represented, such as symbolic links.
+	// By default, these cause an error.
+	SkipUnsupported bool
+
+	// SpoolThreshold is the size above which ToTarWithOptions buffers a file body in a temporary file rather than in memory.
+	// Defaults to 1 MiB.
+	SpoolThreshold int64
+
+	// TempDir is the directory in which ToTarWithOptions creates temporary files.
+	// Defaults to the default directory for temporary files.
+	TempDir string
+}
+
+// FromTar converts a tar archive into files in a file stream.
+// Regular files, directories, hard links, FIFOs, and device nodes are supported.
+// Permissions (including the setuid, setgid, and sticky bits), owner names, and extended attributes (from PAX records) are preserved.
+// The stream is not closed.
+func FromTar(dst *Writer, tr *tar.Reader, opts TarOptions) error {
+	for {
+		th, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		fpath := path.Clean(th.Name)
+		fo := FileOptions{
+			Permissions:      th.FileInfo().Mode() & (os.ModePerm | specialPermissions),
+			ExactPermissions: true,
+			User:             th.Uname,
+			Group:            th.Gname,
+			Xattrs:           tarXattrs(th),
+		}
+
+		switch th.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			fw, err := dst.FileN(fpath, th.Size, fo)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fw, tr)
+			if err != nil {
+				return err
+			}
+			err = fw.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeDir:
+			err = dst.Directory(fpath, fo)
+		case tar.TypeLink:
+			err = dst.Hardlink(fpath, path.Clean(th.Linkname), fo)
+		case tar.TypeFifo:
+			fo.Permissions |= os.ModeNamedPipe
+			err = dst.Special(fpath, 0, 0, fo)
+		case tar.TypeBlock, tar.TypeChar:
+			fo.Permissions |= os.ModeDevice
+			if th.Typeflag == tar.TypeChar {
+				fo.Permissions |= os.ModeCharDevice
+			}
+			err = dst.Special(fpath, uint32(th.Devmajor), uint32(th.Devminor), fo)
+		default:
+			if !opts.SkipUnsupported {
+				return fmt.Errorf("unsupported tar entry type %q: %s", th.Typeflag, th.Name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tarXattrPrefix is the prefix of PAX records which store extended attributes.
+const tarXattrPrefix = "SCHILY.xattr."
+
+// tarXattrs extracts the extended attributes from the PAX records of a tar header.
+func tarXattrs(th *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for k, v := range th.PAXRecords {
+		if !strings.HasPrefix(k, tarXattrPrefix) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string][]byte{}
+		}
+		xattrs[strings.TrimPrefix(k, tarXattrPrefix)] = []byte(v)
+	}
+	return xattrs
+}
+
+// ToTar converts the remaining files in a file stream into a tar archive, using the default TarOptions.
+// The tar writer is not closed.
+func ToTar(src *Reader, tw *tar.Writer) error {
+	return ToTarWithOptions(src, tw, TarOptions{})
+}
+
+// ToTarWithOptions converts the remaining files in a file stream into a tar archive.
+// Since tar headers require the size of the file up front, each file body is buffered before it is written.
+// Files without stored permissions are given a mode of 0755 for directories and 0644 for other files.
+// Bodies larger than opts.SpoolThreshold are buffered in a temporary file, which is removed once the body has been written.
+// Unsupported entries cannot occur in this direction, so SkipUnsupported is ignored.
+// The tar writer is not closed.
+func ToTarWithOptions(src *Reader, tw *tar.Writer, opts TarOptions) error {
+	threshold := opts.SpoolThreshold
+	if threshold <= 0 {
+		threshold = defaultSpoolThreshold
+	}
+	for src.Next() {
+		fr := src.File()
+		fo := fr.Opts()
+		mode := fo.Permissions
+		th := &tar.Header{
+			Name:  fr.Path(),
+			Mode:  tarMode(archivePermissions(fo)),
+			Uname: fo.User,
+			Gname: fo.Group,
+		}
+		for k, v := range fo.Xattrs {
+			if th.PAXRecords == nil {
+				th.PAXRecords = map[string]string{}
+			}
+			th.PAXRecords[tarXattrPrefix+k] = string(v)
+		}
+
+		var body *spool
+		switch {
+		case fr.HardlinkTo() != "":
+			th.Typeflag = tar.TypeLink
+			th.Linkname = fr.HardlinkTo()
+		case mode.IsDir():
+			th.Typeflag = tar.TypeDir
+			if !strings.HasSuffix(th.Name, "/") {
+				th.Name += "/"
+			}
+		case mode&os.ModeNamedPipe != 0:
+			th.Typeflag = tar.TypeFifo
+		case mode&os.ModeDevice != 0:
+			th.Typeflag = tar.TypeBlock
+			if mode&os.ModeCharDevice != 0 {
+				th.Typeflag = tar.TypeChar
+			}
+			major, minor := fr.Device()
+			th.Devmajor, th.Devminor = int64(major), int64(minor)
+		default:
+			th.Typeflag = tar.TypeReg
+			var err error
+			body, err = newSpool(fr, threshold, opts.TempDir)
+			if err != nil {
+				return err
+			}
+			th.Size = body.Size()
+		}
+
+		err := writeTarEntry(tw, th, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return src.Err()
+}
+
+// archivePermissions returns the permission bits (including the setuid, setgid, and sticky bits) of a file for an archive entry.
+// If the stream does not record permissions for the file, the defaults are 0755 for directories and 0644 for other files.
+func archivePermissions(fo FileOptions) os.FileMode {
+	perm := fo.Permissions & (os.ModePerm | specialPermissions)
+	if perm.Perm() == 0 && !fo.ExactPermissions {
+		perm |= normalizePermissions(fo.Permissions)
+	}
+	return perm
+}
+
+// tarMode converts permission bits to the mode of a tar header.
+func tarMode(perm os.FileMode) int64 {
+	mode := int64(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// writeTarEntry writes a header to a tar archive, followed by the body if there is one.
+// The body is closed afterwards.
+func writeTarEntry(tw *tar.Writer, th *tar.Header, body *spool) error {
+	if body != nil {
+		defer body.Close()
+	}
+
+	err := tw.WriteHeader(th)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		_, err = io.Copy(tw, body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
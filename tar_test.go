@@ -0,0 +1,337 @@
+package filestream_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+// buildTar creates an in-memory tar archive with directories, files, a hard link, and a symbolic link.
+func buildTar(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0755, Uname: "usr"}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "dir/hello.txt", Mode: 0600, Uname: "usr", Gname: "grp", Size: 11}, "hello world"},
+		{tar.Header{Typeflag: tar.TypeLink, Name: "dir/link.txt", Linkname: "dir/hello.txt", Mode: 0600}, ""},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "dir/symlink.txt", Linkname: "hello.txt", Mode: 0777}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "dir/setuid", Mode: 04755}, ""},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 01777}, ""},
+	}
+	for _, e := range entries {
+		e := e
+		err := tw.WriteHeader(&e.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(e.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestFromTar(t *testing.T) {
+	dat := buildTar(t)
+
+	// symbolic links are not supported
+	w, err := filestream.NewWriter(ioutil.Discard, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.FromTar(w, tar.NewReader(bytes.NewReader(dat)), filestream.TarOptions{})
+	if err == nil {
+		t.Error("converted a symbolic link")
+	}
+
+	var buf bytes.Buffer
+	w, err = filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.FromTar(w, tar.NewReader(bytes.NewReader(dat)), filestream.TarOptions{SkipUnsupported: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Path, Data, User, Group, Link string
+		Mode                          os.FileMode
+	}
+	var entries []entry
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		fr := r.File()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := fr.Opts()
+		entries = append(entries, entry{fr.Path(), string(data), opts.User, opts.Group, fr.HardlinkTo(), opts.Permissions})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []entry{
+		{Path: "dir", User: "usr", Mode: os.ModeDir | 0755},
+		{Path: "dir/hello.txt", Data: "hello world", User: "usr", Group: "grp", Mode: 0600},
+		{Path: "dir/link.txt", Link: "dir/hello.txt", Mode: 0600},
+		{Path: "dir/setuid", Mode: os.ModeSetuid | 0755},
+		{Path: "tmp", Mode: os.ModeDir | os.ModeSticky | 0777},
+	}
+	if diff := cmp.Diff(expect, entries); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestToTar(t *testing.T) {
+	// tar -> filestream -> tar -> filestream
+	var first bytes.Buffer
+	w, err := filestream.NewWriter(&first, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.FromTar(w, tar.NewReader(bytes.NewReader(buildTar(t))), filestream.TarOptions{SkipUnsupported: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("big.bin", bytes.Repeat([]byte("0123456789"), 10000), filestream.FileOptions{
+		Permissions: 0644,
+		Xattrs:      map[string][]byte{"user.test": []byte("value")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat := first.Bytes()
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.ToTar(r, tw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var second bytes.Buffer
+	w, err = filestream.NewWriter(&second, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.FromTar(w, tar.NewReader(&tbuf), filestream.TarOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(readEntries(t, dat), readEntries(t, second.Bytes())); diff != "" {
+		t.Errorf("stream changed through tar (-want +got):\n%s", diff)
+	}
+}
+
+// tarEntry is a summary of a stream entry.
+type tarEntry struct {
+	Path, Data, Link string
+	Opts             filestream.FileOptions
+}
+
+// readEntries reads all entries from a stream.
+func readEntries(t *testing.T, dat []byte) []tarEntry {
+	t.Helper()
+
+	var entries []tarEntry
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		fr := r.File()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{fr.Path(), string(data), fr.HardlinkTo(), fr.Opts()})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestToTarDefaultPermissions(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/file.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/setuid", []byte("hello"), filestream.FileOptions{Permissions: 0755 | os.ModeSetuid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/locked.txt", []byte("hello"), filestream.FileOptions{ExactPermissions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.ToTar(r, tw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modes := map[string]int64{}
+	tr := tar.NewReader(&tbuf)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes[th.Name] = th.Mode
+	}
+	expect := map[string]int64{
+		"dir/":           0755,
+		"dir/file.txt":   0644,
+		"dir/setuid":     04755,
+		"dir/locked.txt": 0,
+	}
+	if diff := cmp.Diff(expect, modes); diff != "" {
+		t.Errorf("unexpected modes (-want +got):\n%s", diff)
+	}
+}
+
+func TestToTarSpool(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	dat, err := filestream.EncodeToBytes(map[string][]byte{
+		"small.txt": []byte("small"),
+		"big.bin":   big,
+	}, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "filestream-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.ToTarWithOptions(r, tw, filestream.TarOptions{SpoolThreshold: 1000, TempDir: tmp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sizes in the tar headers match the bodies
+	got := map[string][]byte{}
+	tr := tar.NewReader(&tbuf)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(body)) != th.Size {
+			t.Errorf("%s: header size %d does not match body size %d", th.Name, th.Size, len(body))
+		}
+		got[th.Name] = body
+	}
+	if diff := cmp.Diff(map[string][]byte{"small.txt": []byte("small"), "big.bin": big}, got); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+	// temporary files are removed
+	left, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d temporary files were left behind", len(left))
+	}
+
+	// the big file is spooled to disk, so it fails if the temporary directory is missing
+	r, err = filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.ToTarWithOptions(r, tar.NewWriter(ioutil.Discard), filestream.TarOptions{SpoolThreshold: 1000, TempDir: filepath.Join(tmp, "missing")})
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing directory error but got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package filestream
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// VerifyResult is the result of verifying a stream.
+type VerifyResult struct {
+	// Files is the number of entries which were read successfully, including directories, links, and special files.
+	Files int64
+
+	// Bytes is the total size of the file bodies which were read successfully.
+	Bytes int64
+
+	// Anomalies are problems found with individual files.
+	// Corrupt files are skipped over, so they are not included in Files or Bytes.
+	Anomalies []Anomaly
+}
+
+// Anomaly is a problem with a file in a stream.
+type Anomaly struct {
+	// Path is the path of the file.
+	// This is empty if the header of the file was corrupt.
+	Path string
+
+	// Err describes the problem.
+	Err error
+}
+
+// Verify reads an entire stream without extracting it, checking the framing, headers, and (if the stream has them) checksums.
+// Corrupt files are reported as anomalies, and are skipped where possible so that the rest of the stream can be checked.
+// A file body which does not match the size declared in its header is also reported as an anomaly.
+// An error is returned if the stream could not be read to the end.
+func Verify(src io.Reader) (VerifyResult, error) {
+	var res VerifyResult
+	r, err := NewReaderWithOptions(src, ReaderOptions{
+		SkipCorruptFiles: true,
+		OnCorruptFile: func(path string, err error) {
+			res.Anomalies = append(res.Anomalies, Anomaly{path, err})
+		},
+	})
+	if err != nil {
+		return res, err
+	}
+
+	for r.Next() {
+		fr := r.File()
+		n, err := io.Copy(ioutil.Discard, fr)
+		if err != nil {
+			if r.corrupt != nil {
+				// the corrupt file is reported when the reader skips past it
+				continue
+			}
+			return res, err
+		}
+
+		if size, ok := fr.Size(); ok && size != n {
+			res.Anomalies = append(res.Anomalies, Anomaly{fr.Path(), fmt.Errorf("body is %d bytes, but the header declared %d bytes", n, size)})
+		}
+		res.Files++
+		res.Bytes += n
+	}
+
+	return res, r.Err()
+}
@@ -0,0 +1,47 @@
+package filestream_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+)
+
+func TestVerify(t *testing.T) {
+	dat, err := filestream.EncodeToBytes(map[string][]byte{
+		"a.txt": []byte("first file"),
+		"b.txt": []byte("second file"),
+		"c.txt": []byte("third file"),
+	}, filestream.StreamOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := filestream.Verify(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 3 || res.Bytes != int64(len("first filesecond filethird file")) || len(res.Anomalies) != 0 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// corrupt the body of the second file
+	corrupted := bytes.Replace(dat, []byte("second"), []byte("sekond"), 1)
+	res, err = filestream.Verify(bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 2 {
+		t.Errorf("expected 2 intact files but got %d", res.Files)
+	}
+	if len(res.Anomalies) != 1 || res.Anomalies[0].Path != "b.txt" || !errors.Is(res.Anomalies[0].Err, filestream.ErrChecksum) {
+		t.Errorf("expected a checksum anomaly in b.txt but got %+v", res.Anomalies)
+	}
+
+	// truncate the stream
+	_, err = filestream.Verify(bytes.NewReader(dat[:len(dat)-10]))
+	if err == nil {
+		t.Error("verified a truncated stream")
+	}
+}
@@ -0,0 +1,79 @@
+// +build linux darwin
+
+package filestream
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// getXattrs gets the extended attributes of the given file.
+// Filesystems which do not support extended attributes are treated as having none.
+func getXattrs(path string) (map[string][]byte, error) {
+	var buf []byte
+	for {
+		n, err := unix.Listxattr(path, buf)
+		switch {
+		case err == unix.ENOTSUP:
+			return nil, nil
+		case err == unix.ERANGE:
+			// the attributes changed since the size was checked
+			buf = nil
+			continue
+		case err != nil:
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		case buf == nil:
+			if n == 0 {
+				return nil, nil
+			}
+			buf = make([]byte, n)
+			continue
+		}
+		buf = buf[:n]
+		break
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimSuffix(string(buf), "\x00"), "\x00") {
+		val, err := getXattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = val
+	}
+
+	return attrs, nil
+}
+
+// getXattr gets the value of an extended attribute of the given file.
+func getXattr(path string, name string) ([]byte, error) {
+	var buf []byte
+	for {
+		n, err := unix.Getxattr(path, name, buf)
+		switch {
+		case err == unix.ERANGE:
+			// the attribute changed since the size was checked
+			buf = nil
+			continue
+		case err != nil:
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		case buf == nil && n > 0:
+			buf = make([]byte, n)
+			continue
+		}
+		return buf[:n], nil
+	}
+}
+
+// setXattrs sets extended attributes on the given file.
+func setXattrs(path string, attrs map[string][]byte) error {
+	for name, val := range attrs {
+		err := unix.Setxattr(path, name, val, 0)
+		if err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// +build linux darwin
+
+package filestream_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaddr2line/filestream"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrs(t *testing.T) {
+	src := writeTree(t, map[string]string{"hello.txt": "hello world"})
+	defer os.RemoveAll(src)
+	err := unix.Setxattr(filepath.Join(src, "hello.txt"), "user.filestream", []byte("test value"), 0)
+	if err != nil {
+		t.Skipf("extended attributes are not supported: %s", err)
+	}
+
+	dst, err := ioutil.TempDir("", "filestream-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	dat := encodeTree(t, src, filestream.StreamOptions{}, filestream.EncodeOptions{IncludeXattrs: true})
+	r, err := filestream.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filestream.DecodeFiles(r, filestream.DecodeOptions{
+		Base:           dst,
+		PreserveXattrs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := unix.Getxattr(filepath.Join(dst, "hello.txt"), "user.filestream", buf)
+	if err != nil {
+		t.Fatalf("failed to get decoded attribute: %s", err)
+	}
+	if string(buf[:n]) != "test value" {
+		t.Errorf("expected attribute value %q but got %q", "test value", string(buf[:n]))
+	}
+}
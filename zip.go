@@ -0,0 +1,51 @@
+package filestream
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ToZip converts the remaining files in a file stream into a zip archive.
+// File bodies are compressed with deflate, and directories are written as entries with a trailing slash.
+// Zip archives cannot represent hard links or special files, so these result in an error.
+// As with ToTar, files without stored permissions are given a mode of 0755 for directories and 0644 for other files.
+// The zip writer is not closed.
+func ToZip(src *Reader, zw *zip.Writer) error {
+	for src.Next() {
+		fr := src.File()
+		fo := fr.Opts()
+		mode := fo.Permissions
+		switch {
+		case fr.HardlinkTo() != "":
+			return fmt.Errorf("zip archives do not support hard links: %s", fr.Path())
+		case mode&(os.ModeNamedPipe|os.ModeDevice) != 0:
+			return fmt.Errorf("zip archives do not support special files: %s", fr.Path())
+		}
+
+		zh := &zip.FileHeader{
+			Name:   fr.Path(),
+			Method: zip.Deflate,
+		}
+		if mode.IsDir() {
+			zh.Method = zip.Store
+			if !strings.HasSuffix(zh.Name, "/") {
+				zh.Name += "/"
+			}
+		}
+		zh.SetMode(mode.Type() | archivePermissions(fo))
+
+		zf, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(zf, fr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return src.Err()
+}
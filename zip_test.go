@@ -0,0 +1,138 @@
+package filestream_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jaddr2line/filestream"
+)
+
+func TestToZip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{Permissions: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/hello.txt", []byte("hello world"), filestream.FileOptions{Permissions: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("big.bin", bytes.Repeat([]byte("0123456789"), 10000), filestream.FileOptions{Permissions: 0644})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	err = filestream.ToZip(r, zw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Name string
+		Mode os.FileMode
+		Data string
+	}
+	var entries []entry
+	zr, err := zip.NewReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry{zf.Name, zf.Mode(), string(data)})
+	}
+	expect := []entry{
+		{"dir/", os.ModeDir | 0755, ""},
+		{"dir/hello.txt", 0600, "hello world"},
+		{"big.bin", 0644, string(bytes.Repeat([]byte("0123456789"), 10000))},
+	}
+	if diff := cmp.Diff(expect, entries); diff != "" {
+		t.Errorf("unexpected zip entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestToZipDefaultPermissions(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := filestream.NewWriter(&buf, filestream.StreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Directory("dir", filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/file.txt", []byte("hello"), filestream.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteFile("dir/locked.txt", []byte("hello"), filestream.FileOptions{ExactPermissions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := filestream.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	err = filestream.ToZip(r, zw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, zf := range zr.File {
+		modes[zf.Name] = zf.Mode()
+	}
+	expect := map[string]os.FileMode{
+		"dir/":           os.ModeDir | 0755,
+		"dir/file.txt":   0644,
+		"dir/locked.txt": 0,
+	}
+	if diff := cmp.Diff(expect, modes); diff != "" {
+		t.Errorf("unexpected modes (-want +got):\n%s", diff)
+	}
+}